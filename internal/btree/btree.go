@@ -0,0 +1,321 @@
+// Package btree implements an ordered set on top of a B-tree.
+package btree
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// degree is the minimum number of children of an inner node other than the
+// root. Nodes hold between degree-1 and 2*degree-1 keys.
+const (
+	degree   = 32
+	maxItems = 2*degree - 1
+)
+
+// BTree is a set ordered by a comparison function. It is not safe for
+// concurrent use.
+type BTree[T any] struct {
+	cmp    func(a, b T) int
+	root   *node[T]
+	length int
+}
+
+type node[T any] struct {
+	keys []T
+	// children is nil for a leaf, an inner node has one more child than it
+	// has keys.
+	children []*node[T]
+}
+
+// New returns an empty set of strings.
+func New() *BTree[string] {
+	return NewFunc(strings.Compare)
+}
+
+// NewFunc returns an empty set ordered by cmp, which returns a negative
+// number when a sorts before b, zero when they are equal and a positive
+// number otherwise.
+func NewFunc[T any](cmp func(a, b T) int) *BTree[T] {
+	return &BTree[T]{cmp: cmp}
+}
+
+// Len returns the number of keys in the tree.
+func (t *BTree[T]) Len() int {
+	return t.length
+}
+
+// Has reports whether key is in the tree.
+func (t *BTree[T]) Has(key T) bool {
+	for n := t.root; n != nil; {
+		i, found := n.find(t.cmp, key)
+		if found {
+			return true
+		}
+		if n.children == nil {
+			return false
+		}
+		n = n.children[i]
+	}
+	return false
+}
+
+// Insert adds key to the tree and reports whether it was not there yet.
+func (t *BTree[T]) Insert(key T) bool {
+	if t.root == nil {
+		t.root = &node[T]{keys: []T{key}}
+		t.length++
+		return true
+	}
+	if len(t.root.keys) >= maxItems {
+		t.root = &node[T]{children: []*node[T]{t.root}}
+		t.root.split(0)
+	}
+	if !t.root.insert(t.cmp, key) {
+		return false
+	}
+	t.length++
+	return true
+}
+
+// Delete removes key from the tree and reports whether it was there.
+func (t *BTree[T]) Delete(key T) bool {
+	if t.root == nil {
+		return false
+	}
+	removed := t.root.remove(t.cmp, key)
+	if len(t.root.keys) == 0 {
+		if t.root.children == nil {
+			t.root = nil
+		} else {
+			t.root = t.root.children[0]
+		}
+	}
+	if removed {
+		t.length--
+	}
+	return removed
+}
+
+// Ascend calls fn for every key from from on, in order, until fn returns
+// false. The tree must not be changed until Ascend returns.
+func (t *BTree[T]) Ascend(from T, fn func(key T) bool) {
+	t.AscendFunc(func(key T) int { return t.cmp(key, from) }, fn)
+}
+
+// AscendFunc is like Ascend, but starts from the first key for which from
+// returns zero or more. from must be in line with the order of the tree.
+func (t *BTree[T]) AscendFunc(from func(key T) int, fn func(key T) bool) {
+	if t.root != nil {
+		t.root.ascend(from, fn)
+	}
+}
+
+// Clone returns a copy of the tree ordered by cmp, which must order the keys
+// the same way the tree does.
+func (t *BTree[T]) Clone(cmp func(a, b T) int) *BTree[T] {
+	c := &BTree[T]{cmp: cmp, length: t.length}
+	if t.root != nil {
+		c.root = t.root.clone()
+	}
+	return c
+}
+
+// Rewrite replaces every key with fn of it, in order. The keys fn returns
+// must sort the same way the keys they replace do.
+func (t *BTree[T]) Rewrite(fn func(key T) T) {
+	if t.root != nil {
+		t.root.rewrite(fn)
+	}
+}
+
+// find returns the index of the first key of the node not before key and
+// whether it is key.
+func (n *node[T]) find(cmp func(a, b T) int, key T) (int, bool) {
+	return slices.BinarySearchFunc(n.keys, key, cmp)
+}
+
+// split splits the full child i in two around its median key, which moves
+// up into the node.
+func (n *node[T]) split(i int) {
+	child := n.children[i]
+	mid := len(child.keys) / 2
+	right := &node[T]{keys: slices.Clone(child.keys[mid+1:])}
+	if child.children != nil {
+		right.children = slices.Clone(child.children[mid+1:])
+		clear(child.children[mid+1:])
+		child.children = child.children[:mid+1]
+	}
+	median := child.keys[mid]
+	clear(child.keys[mid:])
+	child.keys = child.keys[:mid]
+
+	n.keys = slices.Insert(n.keys, i, median)
+	n.children = slices.Insert(n.children, i+1, right)
+}
+
+// insert adds key below the node, which must not be full.
+func (n *node[T]) insert(cmp func(a, b T) int, key T) bool {
+	i, found := n.find(cmp, key)
+	if found {
+		return false
+	}
+	if n.children == nil {
+		n.keys = slices.Insert(n.keys, i, key)
+		return true
+	}
+	if len(n.children[i].keys) >= maxItems {
+		n.split(i)
+		switch c := cmp(key, n.keys[i]); {
+		case c == 0:
+			return false
+		case c > 0:
+			i++
+		}
+	}
+	return n.children[i].insert(cmp, key)
+}
+
+// remove removes key from below the node. Every node it descends into is
+// first given at least degree keys, so removing one never leaves it short.
+func (n *node[T]) remove(cmp func(a, b T) int, key T) bool {
+	i, found := n.find(cmp, key)
+	if n.children == nil {
+		if !found {
+			return false
+		}
+		n.keys = deleteAt(n.keys, i)
+		return true
+	}
+
+	if found {
+		switch {
+		case len(n.children[i].keys) >= degree:
+			// replace the key with its predecessor
+			prev := n.children[i].max()
+			n.keys[i] = prev
+			return n.children[i].remove(cmp, prev)
+		case len(n.children[i+1].keys) >= degree:
+			// replace the key with its successor
+			next := n.children[i+1].min()
+			n.keys[i] = next
+			return n.children[i+1].remove(cmp, next)
+		default:
+			n.merge(i)
+			return n.children[i].remove(cmp, key)
+		}
+	}
+
+	if len(n.children[i].keys) < degree {
+		i = n.grow(i)
+	}
+	return n.children[i].remove(cmp, key)
+}
+
+// grow gives child i at least degree keys, borrowing one from a sibling or
+// merging it with one. It returns the index of the child that now holds the
+// keys of child i.
+func (n *node[T]) grow(i int) int {
+	child := n.children[i]
+	switch {
+	case i > 0 && len(n.children[i-1].keys) >= degree:
+		left := n.children[i-1]
+		child.keys = slices.Insert(child.keys, 0, n.keys[i-1])
+		n.keys[i-1] = left.keys[len(left.keys)-1]
+		left.keys = deleteAt(left.keys, len(left.keys)-1)
+		if left.children != nil {
+			child.children = slices.Insert(child.children, 0, left.children[len(left.children)-1])
+			left.children = deleteAt(left.children, len(left.children)-1)
+		}
+		return i
+	case i < len(n.keys) && len(n.children[i+1].keys) >= degree:
+		right := n.children[i+1]
+		child.keys = append(child.keys, n.keys[i])
+		n.keys[i] = right.keys[0]
+		right.keys = deleteAt(right.keys, 0)
+		if right.children != nil {
+			child.children = append(child.children, right.children[0])
+			right.children = deleteAt(right.children, 0)
+		}
+		return i
+	case i < len(n.keys):
+		n.merge(i)
+		return i
+	default:
+		n.merge(i - 1)
+		return i - 1
+	}
+}
+
+// merge folds key i and child i+1 into child i.
+func (n *node[T]) merge(i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.keys = append(left.keys, n.keys[i])
+	left.keys = append(left.keys, right.keys...)
+	left.children = append(left.children, right.children...)
+	n.keys = deleteAt(n.keys, i)
+	n.children = deleteAt(n.children, i+1)
+}
+
+func (n *node[T]) min() T {
+	for n.children != nil {
+		n = n.children[0]
+	}
+	return n.keys[0]
+}
+
+func (n *node[T]) max() T {
+	for n.children != nil {
+		n = n.children[len(n.children)-1]
+	}
+	return n.keys[len(n.keys)-1]
+}
+
+func (n *node[T]) ascend(from func(key T) int, fn func(key T) bool) bool {
+	i := sort.Search(len(n.keys), func(i int) bool { return from(n.keys[i]) >= 0 })
+	for ; i < len(n.keys); i++ {
+		if n.children != nil && !n.children[i].ascend(from, fn) {
+			return false
+		}
+		if !fn(n.keys[i]) {
+			return false
+		}
+	}
+	if n.children != nil {
+		return n.children[i].ascend(from, fn)
+	}
+	return true
+}
+
+func (n *node[T]) clone() *node[T] {
+	c := &node[T]{keys: slices.Clone(n.keys)}
+	if n.children != nil {
+		c.children = make([]*node[T], len(n.children))
+		for i, child := range n.children {
+			c.children[i] = child.clone()
+		}
+	}
+	return c
+}
+
+func (n *node[T]) rewrite(fn func(key T) T) {
+	for i := range n.keys {
+		if n.children != nil {
+			n.children[i].rewrite(fn)
+		}
+		n.keys[i] = fn(n.keys[i])
+	}
+	if n.children != nil {
+		n.children[len(n.keys)].rewrite(fn)
+	}
+}
+
+// deleteAt removes element i of s, clearing the slot it leaves behind so the
+// tree does not hold on to it.
+func deleteAt[S ~[]E, E any](s S, i int) S {
+	copy(s[i:], s[i+1:])
+	var zero E
+	s[len(s)-1] = zero
+	return s[:len(s)-1]
+}
@@ -0,0 +1,104 @@
+package btree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func keys(t *BTree[string], from string) []string {
+	var got []string
+	t.Ascend(from, func(key string) bool {
+		got = append(got, key)
+		return true
+	})
+	return got
+}
+
+func TestRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree := New()
+	want := make(map[string]bool)
+
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%05d", r.Intn(5000))
+		if r.Intn(3) == 0 {
+			if got := tree.Delete(key); got != want[key] {
+				t.Fatalf("delete %s: got %v, want %v", key, got, want[key])
+			}
+			delete(want, key)
+			continue
+		}
+		if got := tree.Insert(key); got == want[key] {
+			t.Fatalf("insert %s: got %v", key, got)
+		}
+		want[key] = true
+	}
+
+	sorted := make([]string, 0, len(want))
+	for key := range want {
+		sorted = append(sorted, key)
+		if !tree.Has(key) {
+			t.Fatalf("missing %s", key)
+		}
+	}
+	sort.Strings(sorted)
+	if tree.Len() != len(sorted) {
+		t.Fatalf("got %d keys, want %d", tree.Len(), len(sorted))
+	}
+
+	for _, from := range []string{"", "key00000", "key02500", "key025005", "key99999"} {
+		i := sort.SearchStrings(sorted, from)
+		got := keys(tree, from)
+		if fmt.Sprint(got) != fmt.Sprint(sorted[i:]) {
+			t.Fatalf("ascend from %q: got %d keys, want %d", from, len(got), len(sorted)-i)
+		}
+	}
+
+	for _, key := range sorted {
+		if !tree.Delete(key) {
+			t.Fatalf("delete %s failed", key)
+		}
+	}
+	if tree.Len() != 0 || tree.root != nil {
+		t.Fatalf("tree not empty after deleting every key")
+	}
+}
+
+func TestAscendStop(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.Insert(fmt.Sprintf("%04d", i))
+	}
+
+	var got []string
+	tree.Ascend("0500", func(key string) bool {
+		got = append(got, key)
+		return len(got) < 3
+	})
+	if fmt.Sprint(got) != "[0500 0501 0502]" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestCloneRewrite(t *testing.T) {
+	tree := New()
+	for i := 0; i < 1000; i++ {
+		tree.Insert(fmt.Sprintf("%04d", i))
+	}
+
+	clone := tree.Clone(strings.Compare)
+	clone.Rewrite(func(key string) string { return "x" + key })
+	if clone.Delete("0000") || !clone.Delete("x0000") || clone.Len() != 999 {
+		t.Fatal("clone does not hold the rewritten keys")
+	}
+	got := keys(clone, "")
+	if len(got) != 999 || got[0] != "x0001" || got[998] != "x0999" {
+		t.Fatalf("clone: got %d keys from %s", len(got), got[0])
+	}
+	if got := keys(tree, ""); len(got) != 1000 || got[0] != "0000" {
+		t.Fatal("rewriting the clone changed the tree")
+	}
+}
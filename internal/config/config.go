@@ -1,29 +1,124 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"time"
 )
 
 var (
 	// debug
-	defaultSyncInterval           = time.Minute * 1
-	defaultMergeInterval          = time.Minute * 3
-	defaultDatafileChangeInterval = time.Minute * 2
+	defaultSyncInterval  = time.Minute * 1
+	defaultMergeInterval = time.Minute * 3
+	// defaultExpireInterval is how often expired keys are swept from memory
+	defaultExpireInterval = time.Second
+
+	defaultSyncBytes int64 = 1024 * 1024
+
+	defaultMaxDatafileSize int64 = 128 * 1024 * 1024
+
+	defaultMergeDeadRatio = 0.5
+
+	defaultKeyDirShards = 32
+
+	defaultBackupDir = "backups"
 )
 
 const (
-	IOBufferLength    = 512
+	IOBufferLength    = 16 * 1024
 	IOBufferLengthMax = 50 * 1024
+
+	// BulkLengthMax is the largest key or value accepted in a single bulk argument.
+	BulkLengthMax = 512 * 1024 * 1024
+	// MultiBulkLengthMax is the largest number of arguments accepted in one command.
+	MultiBulkLengthMax = 1024 * 1024
 )
 
+// SyncMode is when appends to the active datafile are synced to disk. A
+// write can ask to be synced whatever the mode, and the active datafile is
+// always synced when it is sealed or the store shuts down.
+type SyncMode int
+
+const (
+	// SyncNever leaves writing appends back to the operating system.
+	SyncNever SyncMode = iota
+	// SyncEveryInterval syncs every SyncInterval.
+	SyncEveryInterval
+	// SyncEveryWrite syncs before every write is acknowledged.
+	SyncEveryWrite
+	// SyncEveryBytes syncs once SyncBytes were appended since the last sync.
+	SyncEveryBytes
+)
+
+var syncModes = []string{"never", "interval", "always", "bytes"}
+
+func (m SyncMode) String() string {
+	if m < 0 || int(m) >= len(syncModes) {
+		return fmt.Sprintf("SyncMode(%d)", int(m))
+	}
+	return syncModes[m]
+}
+
+// ParseSyncMode returns the SyncMode called name: never, interval, always
+// or bytes.
+func ParseSyncMode(name string) (SyncMode, error) {
+	for i, mode := range syncModes {
+		if name == mode {
+			return SyncMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sync mode %q, want one of never, interval, always or bytes", name)
+}
+
 type Opts struct {
-	Dir                    string
-	Path                   string
-	Fsync                  bool
-	SyncInterval           time.Duration
-	MergeInterval          time.Duration
-	DatafileChangeInterval time.Duration
+	Dir  string
+	Path string
+	// Sync is when appends are synced to disk.
+	Sync SyncMode
+	// SyncInterval is how often SyncEveryInterval syncs.
+	SyncInterval time.Duration
+	// SyncBytes is how many bytes SyncEveryBytes lets through unsynced.
+	SyncBytes     int64
+	MergeInterval time.Duration
+	// ExpireInterval is how often keys that expired are removed from the
+	// key directory. Expired keys read as missing either way.
+	ExpireInterval time.Duration
+	// MaxDatafileSize is the size in bytes after which the active datafile is
+	// sealed and writes move on to a new one.
+	MaxDatafileSize int64
+	// MergeDeadRatio is the share of dead bytes in a sealed datafile from
+	// which a merge rewrites it.
+	MergeDeadRatio float64
+	// MergeMinDeadBytes is the number of dead bytes in a sealed datafile from
+	// which a merge rewrites it whatever its ratio, zero turns it off.
+	MergeMinDeadBytes int64
+	// ReadOnly opens the data directory for reading only. A read-only store
+	// does not take the directory lock, so tools can inspect a directory a
+	// server is writing to.
+	ReadOnly bool
+	// CompactKeyDir keeps the key directory in large pointer-free slabs
+	// rather than in a map, which takes far less memory and garbage
+	// collection work per key at some cost in speed.
+	CompactKeyDir bool
+	// KeyDirShards is the number of shards the key directory is split
+	// into, each with its own lock.
+	KeyDirShards int
+	// MmapReads maps sealed datafiles into memory and reads them from there
+	// rather than with a system call per read.
+	MmapReads bool
+	// GroupCommit lets concurrent writers share a sync with SyncEveryWrite:
+	// each write is acknowledged once a sync that covers it is done.
+	GroupCommit bool
+	// GroupCommitWait is how long a sync waits for more writers to join it,
+	// zero syncs at once with whoever appended meanwhile.
+	GroupCommitWait time.Duration
+	// GroupCommitSize is the number of waiting writers that starts a sync
+	// before GroupCommitWait is up, zero for no limit.
+	GroupCommitSize int
+	// BackupDir is the directory BACKUP writes checkpoints under, clients
+	// can only name a directory within it. A relative directory is resolved
+	// against the directory path.
+	BackupDir string
 }
 
 type Config struct {
@@ -35,18 +130,118 @@ type OptFunc func(*Opts)
 func defaultOpts() Opts {
 	wd, _ := os.Getwd()
 	return Opts{
-		Dir:                    ".data",
-		Path:                   wd,
-		Fsync:                  false,
-		SyncInterval:           defaultSyncInterval,
-		MergeInterval:          defaultMergeInterval,
-		DatafileChangeInterval: defaultDatafileChangeInterval,
+		Dir:             ".data",
+		Path:            wd,
+		Sync:            SyncEveryInterval,
+		SyncInterval:    defaultSyncInterval,
+		SyncBytes:       defaultSyncBytes,
+		MergeInterval:   defaultMergeInterval,
+		ExpireInterval:  defaultExpireInterval,
+		MaxDatafileSize: defaultMaxDatafileSize,
+		MergeDeadRatio:  defaultMergeDeadRatio,
+		KeyDirShards:    defaultKeyDirShards,
+		BackupDir:       defaultBackupDir,
 	}
 }
 
+func WithSyncMode(mode SyncMode) OptFunc {
+	return func(opts *Opts) {
+		opts.Sync = mode
+	}
+}
+
+// WithFsync syncs every write when fsync is set, and every SyncInterval
+// otherwise.
 func WithFsync(fsync bool) OptFunc {
 	return func(opts *Opts) {
-		opts.Fsync = fsync
+		opts.Sync = SyncEveryInterval
+		if fsync {
+			opts.Sync = SyncEveryWrite
+		}
+	}
+}
+
+func WithSyncBytes(size int64) OptFunc {
+	return func(opts *Opts) {
+		opts.SyncBytes = size
+	}
+}
+
+func WithMaxDatafileSize(size int64) OptFunc {
+	return func(opts *Opts) {
+		opts.MaxDatafileSize = size
+	}
+}
+
+func WithReadOnly(readOnly bool) OptFunc {
+	return func(opts *Opts) {
+		opts.ReadOnly = readOnly
+	}
+}
+
+func WithCompactKeyDir(compact bool) OptFunc {
+	return func(opts *Opts) {
+		opts.CompactKeyDir = compact
+	}
+}
+
+func WithKeyDirShards(shards int) OptFunc {
+	return func(opts *Opts) {
+		opts.KeyDirShards = shards
+	}
+}
+
+func WithMmapReads(mmap bool) OptFunc {
+	return func(opts *Opts) {
+		opts.MmapReads = mmap
+	}
+}
+
+func WithGroupCommit(groupCommit bool) OptFunc {
+	return func(opts *Opts) {
+		opts.GroupCommit = groupCommit
+	}
+}
+
+func WithGroupCommitWait(wait time.Duration) OptFunc {
+	return func(opts *Opts) {
+		opts.GroupCommitWait = wait
+	}
+}
+
+func WithGroupCommitSize(size int) OptFunc {
+	return func(opts *Opts) {
+		opts.GroupCommitSize = size
+	}
+}
+
+func WithMergeDeadRatio(ratio float64) OptFunc {
+	return func(opts *Opts) {
+		opts.MergeDeadRatio = ratio
+	}
+}
+
+func WithMergeMinDeadBytes(size int64) OptFunc {
+	return func(opts *Opts) {
+		opts.MergeMinDeadBytes = size
+	}
+}
+
+func WithSyncInterval(interval time.Duration) OptFunc {
+	return func(opts *Opts) {
+		opts.SyncInterval = interval
+	}
+}
+
+func WithMergeInterval(interval time.Duration) OptFunc {
+	return func(opts *Opts) {
+		opts.MergeInterval = interval
+	}
+}
+
+func WithExpireInterval(interval time.Duration) OptFunc {
+	return func(opts *Opts) {
+		opts.ExpireInterval = interval
 	}
 }
 
@@ -56,6 +251,21 @@ func WithDirectoryPath(path string) OptFunc {
 	}
 }
 
+// WithDirectory sets the data directory. A relative directory is resolved
+// against the directory path.
+func WithDirectory(dir string) OptFunc {
+	return func(opts *Opts) {
+		opts.Dir = dir
+	}
+}
+
+// WithBackupDir sets the directory BACKUP writes checkpoints under.
+func WithBackupDir(dir string) OptFunc {
+	return func(opts *Opts) {
+		opts.BackupDir = dir
+	}
+}
+
 func NewConfig(opts ...OptFunc) *Config {
 	o := defaultOpts()
 	for _, fn := range opts {
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// WriteBatch collects writes that Store.Write applies atomically: after a
+// crash either all of them are found or none. The zero value is an empty
+// batch ready to use.
+type WriteBatch struct {
+	records []*Record
+}
+
+// Put adds a write of value for key to the batch.
+func (b *WriteBatch) Put(key string, value []byte) {
+	b.put(key, value, 0)
+}
+
+// put adds a write of value for key expiring at expiry to the batch.
+func (b *WriteBatch) put(key string, value []byte, expiry uint64) {
+	b.records = append(b.records, newRecord(key, value, recordValue, expiry))
+}
+
+// Delete adds a deletion of key to the batch.
+func (b *WriteBatch) Delete(key string) {
+	b.records = append(b.records, newRecord(key, nil, recordTombstone, 0))
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.records = b.records[:0]
+}
+
+// newBatchMarker returns the marker of type typ for a batch of n records.
+func newBatchMarker(typ recordType, n int) *Record {
+	return newRecord("", binary.BigEndian.AppendUint32(nil, uint32(n)), typ, 0)
+}
+
+// batchCount returns the number of records a batch marker stands for, -1
+// when the marker is malformed.
+func batchCount(marker *Record) int {
+	if len(marker.Value) != 4 {
+		return -1
+	}
+	return int(binary.BigEndian.Uint32(marker.Value))
+}
+
+// Write applies the writes of the batch in order. They are appended to the
+// active datafile in a single write between a begin and a commit marker, and
+// the key directory is updated under one lock, so readers see either none or
+// all of them.
+func (s *Store) Write(b *WriteBatch) error {
+	_, err := s.commit(b, nil)
+	return err
+}
+
+// commit applies the batch like Write, unless one of the watched keys no
+// longer has the version it was watched at, and reports whether it did. The
+// versions are checked under the same lock the batch is applied with.
+func (s *Store) commit(b *WriteBatch, watched map[string]uint64) (bool, error) {
+	ok, seq, err := s.commitBatch(b, watched)
+	if !ok || err != nil || seq == 0 {
+		return ok, err
+	}
+	return true, s.waitDurable(seq)
+}
+
+// commitBatch applies the batch like commit without waiting for a sync. It
+// also returns the count of appends the batch is part of, zero when nothing
+// was written.
+func (s *Store) commitBatch(b *WriteBatch, watched map[string]uint64) (bool, uint64, error) {
+	if s.cfg.ReadOnly && len(b.records) > 0 {
+		return false, 0, ErrReadOnly
+	}
+
+	buffer := s.BufferPool.Get().(*bytes.Buffer)
+	defer s.BufferPool.Put(buffer)
+	defer buffer.Reset()
+
+	records, ends, err := s.encodeBatch(b, buffer)
+	if err != nil {
+		return false, 0, err
+	}
+
+	s.Lock()
+	ok, err := s.appendBatch(records, buffer.Bytes(), ends, watched)
+	seq := s.appends
+	s.Unlock()
+	if !ok || len(records) == 0 {
+		seq = 0
+	}
+	return ok, seq, err
+}
+
+// transact applies the batch build returns, unless one of the watched keys
+// no longer has the version it was watched at, and reports whether it did.
+// build is called with the store lock held, so nothing it reads changes
+// before its batch is applied. It must not take the store lock.
+func (s *Store) transact(watched map[string]uint64, build func() *WriteBatch) (bool, error) {
+	ok, seq, err := s.transactBatch(watched, build)
+	if !ok || err != nil || seq == 0 {
+		return ok, err
+	}
+	return true, s.waitDurable(seq)
+}
+
+// transactBatch applies a batch like transact without waiting for a sync. It
+// also returns the count of appends the batch is part of, zero when nothing
+// was written.
+func (s *Store) transactBatch(watched map[string]uint64, build func() *WriteBatch) (bool, uint64, error) {
+	buffer := s.BufferPool.Get().(*bytes.Buffer)
+	defer s.BufferPool.Put(buffer)
+	defer buffer.Reset()
+
+	s.Lock()
+	defer s.Unlock()
+	for key, version := range watched {
+		if s.keyVersion(key) != version {
+			return false, 0, nil
+		}
+	}
+
+	b := build()
+	if s.cfg.ReadOnly && len(b.records) > 0 {
+		return false, 0, ErrReadOnly
+	}
+	records, ends, err := s.encodeBatch(b, buffer)
+	if err != nil {
+		return false, 0, err
+	}
+	ok, err := s.appendBatch(records, buffer.Bytes(), ends, nil)
+	if !ok || len(records) == 0 {
+		return ok, 0, err
+	}
+	return true, s.appends, err
+}
+
+// encodeBatch encodes the records of the batch between its markers into
+// buffer. It returns the records along with where each of them ends.
+func (s *Store) encodeBatch(b *WriteBatch, buffer *bytes.Buffer) ([]*Record, []uint32, error) {
+	var records []*Record
+	if len(b.records) > 0 {
+		records = make([]*Record, 0, len(b.records)+2)
+		records = append(records, newBatchMarker(recordBatchBegin, len(b.records)))
+		records = append(records, b.records...)
+		records = append(records, newBatchMarker(recordBatchCommit, len(b.records)))
+	}
+
+	ends := make([]uint32, len(records))
+	for i, record := range records {
+		if err := record.encode(buffer); err != nil {
+			const msg = "unable to encode record"
+			s.Log.Error(msg, zap.Error(err))
+			return nil, nil, fmt.Errorf(msg+": %w", err)
+		}
+		ends[i] = uint32(buffer.Len())
+	}
+	return records, ends, nil
+}
+
+// appendBatch appends the encoded records of a batch, ending at ends in
+// object, unless a watched key changed, and reports whether it did. The
+// caller must hold the store lock.
+func (s *Store) appendBatch(records []*Record, object []byte, ends []uint32, watched map[string]uint64) (bool, error) {
+	for key, version := range watched {
+		if s.keyVersion(key) != version {
+			return false, nil
+		}
+	}
+	if len(records) == 0 {
+		return true, nil
+	}
+
+	if s.dataFile.IsFull(s.cfg.MaxDatafileSize, len(object)) {
+		if err := s.updateActiveDatafile(s.FileId + 1); err != nil {
+			return false, err
+		}
+	}
+
+	offset, err := s.dataFile.Append(object)
+	if err != nil {
+		const msg = "unable to append batch"
+		s.Log.Error(msg, zap.Error(err))
+		return false, fmt.Errorf(msg+": %w", err)
+	}
+	err = s.appended(len(object))
+
+	// the markers are dead as soon as they are written
+	for i := 1; i < len(records)-1; i++ {
+		s.indexRecord(records[i], uint32(offset)+ends[i-1], ends[i]-ends[i-1])
+	}
+
+	return true, err
+}
@@ -0,0 +1,366 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ajaxchavan/bytecask/internal/datafile"
+)
+
+// manifestFile is the name of the file listing the files of a checkpoint. It
+// is written last, a checkpoint without one is incomplete.
+const manifestFile = "MANIFEST"
+
+type manifest struct {
+	Created time.Time       `json:"created"`
+	Files   []manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+}
+
+// backupState tracks the checkpoints BACKUP writes in the background, one at
+// a time.
+type backupState struct {
+	sync.Mutex
+	wg sync.WaitGroup
+	// dir is the directory of the last backup as the client named it, err the
+	// error it failed with.
+	dir     string
+	running bool
+	err     error
+}
+
+// backupDir returns the directory BACKUP writes checkpoints under.
+func (s *Store) backupDir() string {
+	if filepath.IsAbs(s.cfg.BackupDir) {
+		return s.cfg.BackupDir
+	}
+	return filepath.Join(s.cfg.Path, s.cfg.BackupDir)
+}
+
+// startBackup writes a checkpoint into the directory called name within the
+// backup directory in the background, unless one is being written already.
+// Absolute names and names that climb out with ".." are refused, as is a
+// directory that cannot be used, right away.
+func (s *Store) startBackup(name string) error {
+	if s.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+	if !filepath.IsLocal(name) {
+		return errBackupPath
+	}
+	dir := filepath.Join(s.backupDir(), name)
+
+	b := &s.backup
+	b.Lock()
+	defer b.Unlock()
+	if b.running {
+		return errBackupRunning
+	}
+	if err := prepareDirectory(dir); err != nil {
+		return err
+	}
+
+	b.dir, b.running, b.err = name, true, nil
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		err := s.Checkpoint(dir)
+		b.Lock()
+		defer b.Unlock()
+		b.running, b.err = false, err
+	}()
+	return nil
+}
+
+// backupStatus describes the last backup started: none, running, ok or
+// failed along with its directory and error.
+func (s *Store) backupStatus() string {
+	b := &s.backup
+	b.Lock()
+	defer b.Unlock()
+	switch {
+	case b.dir == "":
+		return "none"
+	case b.running:
+		return "running " + b.dir
+	case b.err != nil:
+		return fmt.Sprintf("failed %s: %v", b.dir, b.err)
+	}
+	return "ok " + b.dir
+}
+
+// Checkpoint writes a copy of the store as it is now into dir, which must be
+// empty or not exist. The active datafile is sealed first, then every sealed
+// datafile is hard linked into dir, or copied when dir is on another file
+// system, along with its hint file. A manifest with the size and checksum of
+// every file is written last. Reads and writes go on meanwhile.
+func (s *Store) Checkpoint(dir string) error {
+	if s.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := prepareDirectory(dir); err != nil {
+		const msg = "failed to prepare checkpoint directory"
+		s.Log.Error(msg, zap.Error(err), zap.String("dir", dir))
+		return fmt.Errorf(msg+": %w", err)
+	}
+
+	s.Lock()
+	if s.dataFile.Size() > 0 {
+		if err := s.updateActiveDatafile(s.FileId + 1); err != nil {
+			s.Unlock()
+			return err
+		}
+	}
+	files := make(datafile.FileDir, len(s.FileDir))
+	for fileId, df := range s.FileDir {
+		if fileId != s.FileId {
+			files[fileId] = df
+		}
+	}
+	s.hold(files)
+	s.Unlock()
+	defer s.release(files)
+
+	// the hint file of the datafile just sealed is written in the background
+	s.hints.waitFor(files)
+
+	ids := make([]int, 0, len(files))
+	for fileId := range files {
+		ids = append(ids, fileId)
+	}
+	sort.Ints(ids)
+
+	m := manifest{Created: time.Now().UTC()}
+	for _, fileId := range ids {
+		names, err := s.checkpointDatafile(dir, fileId, files[fileId])
+		if err != nil {
+			const msg = "failed to checkpoint datafile"
+			s.Log.Error(msg, zap.Error(err), zap.Int("fileId", fileId))
+			return fmt.Errorf(msg+": %w", err)
+		}
+		for _, name := range names {
+			entry, err := checksumFile(dir, name)
+			if err != nil {
+				const msg = "failed to checksum checkpoint file"
+				s.Log.Error(msg, zap.Error(err), zap.String("name", name))
+				return fmt.Errorf(msg+": %w", err)
+			}
+			m.Files = append(m.Files, entry)
+		}
+	}
+
+	if err := writeManifest(dir, &m); err != nil {
+		const msg = "failed to write checkpoint manifest"
+		s.Log.Error(msg, zap.Error(err))
+		return fmt.Errorf(msg+": %w", err)
+	}
+	s.Log.Info("wrote checkpoint", zap.String("dir", dir), zap.Int("datafiles", len(ids)))
+	return nil
+}
+
+// checkpointDatafile puts the datafile identified by fileId and its hint file
+// into dir and returns their names. A hint file that is missing or does not
+// match the datafile is written afresh.
+func (s *Store) checkpointDatafile(dir string, fileId int, df *datafile.Datafile) ([]string, error) {
+	path := datafile.GetDatafile(s.dir(), fileId)
+	hint := GetHintFile(s.dir(), fileId)
+	names := []string{filepath.Base(path), filepath.Base(hint)}
+
+	if err := linkOrCopy(path, filepath.Join(dir, names[0])); err != nil {
+		return nil, err
+	}
+	if _, err := s.readHintFile(fileId, df); err == nil {
+		return names, linkOrCopy(hint, filepath.Join(dir, names[1]))
+	}
+	entries, _, err := s.scanHintEntries(df)
+	if err != nil {
+		return nil, err
+	}
+	return names, writeHintFile(filepath.Join(dir, names[1]), entries, uint32(df.Size()))
+}
+
+// Restore puts the checkpoint in dir in place as the data directory dataDir,
+// which must not hold any datafiles. Every file is checked against the
+// manifest before anything is copied. The files are copied rather than
+// linked, the newest datafile is appended to once the store is opened.
+func Restore(dir, dataDir string) error {
+	m, err := verifyCheckpoint(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := createDirectory(dataDir); err != nil {
+		return err
+	}
+	lock, err := lockDirectory(dataDir)
+	if err != nil {
+		return err
+	}
+	defer unlockDirectory(lock)
+
+	existing, err := filepath.Glob(filepath.Join(dataDir, "*.db"))
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("%w: %s", ErrNotEmpty, dataDir)
+	}
+
+	// the files only get their names once all of them are copied, a restore
+	// cut short leaves temporary files the store removes when opened
+	for _, entry := range m.Files {
+		if err := copyFile(filepath.Join(dir, entry.Name), filepath.Join(dataDir, entry.Name)+tempExt); err != nil {
+			return err
+		}
+	}
+	for _, entry := range m.Files {
+		path := filepath.Join(dataDir, entry.Name)
+		if err := os.Rename(path+tempExt, path); err != nil {
+			return err
+		}
+	}
+	return syncDirectory(dataDir)
+}
+
+// verifyCheckpoint checks every file of the checkpoint in dir against its
+// manifest and returns the manifest.
+func verifyCheckpoint(dir string) (*manifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptCheckpoint, err)
+	}
+
+	for _, want := range m.Files {
+		if filepath.Base(want.Name) != want.Name {
+			return nil, fmt.Errorf("%w: bad file name %q", ErrCorruptCheckpoint, want.Name)
+		}
+		got, err := checksumFile(dir, want.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptCheckpoint, err)
+		}
+		if got != want {
+			return nil, fmt.Errorf("%w: %s has %d bytes with checksum %08x, want %d bytes with checksum %08x",
+				ErrCorruptCheckpoint, want.Name, got.Size, got.CRC32, want.Size, want.CRC32)
+		}
+	}
+	return &m, nil
+}
+
+// prepareDirectory creates dir, or checks that it is empty if it exists.
+func prepareDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return createDirectory(dir)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%w: %s", ErrNotEmpty, dir)
+	}
+	return nil
+}
+
+func writeManifest(dir string, m *manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, manifestFile)
+	f, err := os.OpenFile(path+tempExt, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+tempExt, path); err != nil {
+		return err
+	}
+	return syncDirectory(dir)
+}
+
+// checksumFile returns the manifest entry of the file name in dir.
+func checksumFile(dir, name string) (manifestEntry, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	return manifestEntry{Name: name, Size: n, CRC32: h.Sum32()}, nil
+}
+
+// linkOrCopy hard links src to dst, and copies it when linking fails, for
+// instance because dst is on another file system.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile copies src to dst and syncs it to disk.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDirectory syncs dir so the files renamed into it stay after a crash.
+func syncDirectory(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir, config.WithMaxDatafileSize(256))
+	defer store.Close()
+	run := sessionRunner(store.NewSession())
+
+	for i := 0; i < 30; i++ {
+		if err := store.set(fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.del("key00"); err != nil {
+		t.Fatal(err)
+	}
+
+	backup := filepath.Join(dir, "backups", "daily", "backup")
+	if got := run("BACKUP", "status"); got != "$4\r\nnone\r\n" {
+		t.Fatalf("status before any backup: got %q", got)
+	}
+	if got := run("BACKUP", "daily/backup"); got != "+Backup started\r\n" {
+		t.Fatalf("backup: got %q", got)
+	}
+	if got, want := waitBackup(t, run), "ok daily/backup"; got != want {
+		t.Fatalf("backup status: got %q, want %q", got, want)
+	}
+	if got := run("BACKUP", "daily/backup"); got != "-ERR backup directory is not empty\r\n" {
+		t.Fatalf("backup into a used directory: got %q", got)
+	}
+	// writes after the checkpoint are not part of it
+	if err := store.set("key01", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := filepath.Join(t.TempDir(), "restored")
+	if err := Restore(backup, restored); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(backup, restored); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("restore into a used directory: got %v", err)
+	}
+
+	copied := newTestStore(t, restored, config.WithDirectory(""))
+	defer copied.Close()
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		got, err := copied.get(key)
+		if i == 0 {
+			if err != ErrKeyNotFound {
+				t.Fatalf("get %s: got %q, %v", key, got, err)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("value%d", i); err != nil || string(got) != want {
+			t.Fatalf("get %s: got %q, %v, want %q", key, got, err, want)
+		}
+	}
+	// appending to the restored copy leaves the checkpoint alone
+	if err := copied.set("key01", []byte("restored")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyCheckpoint(backup); err != nil {
+		t.Fatalf("checkpoint changed after the restore: %v", err)
+	}
+
+	// a damaged checkpoint is refused
+	path := filepath.Join(backup, "data_1.db")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	// the datafile is hard linked with the store's, replace it rather than
+	// write into it
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(backup, t.TempDir()); !errors.Is(err, ErrCorruptCheckpoint) {
+		t.Fatalf("restore of a damaged checkpoint: got %v", err)
+	}
+}
+
+// waitBackup polls BACKUP STATUS until the backup is done and returns its
+// status.
+func waitBackup(t *testing.T, run func(args ...string) string) string {
+	t.Helper()
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		reply := run("BACKUP", "STATUS")
+		// the status is a bulk string
+		_, status, ok := strings.Cut(strings.TrimSuffix(reply, "\r\n"), "\r\n")
+		if !ok {
+			t.Fatalf("backup status: got %q", reply)
+		}
+		if !strings.HasPrefix(status, "running ") {
+			return status
+		}
+	}
+	t.Fatal("backup still running")
+	return ""
+}
+
+func TestBackupInBackground(t *testing.T) {
+	root := t.TempDir()
+	store := newTestStore(t, t.TempDir(), config.WithBackupDir(root))
+	defer store.Close()
+	run := sessionRunner(store.NewSession())
+
+	if err := store.set("key", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// one backup at a time
+	store.backup.Lock()
+	store.backup.running = true
+	store.backup.Unlock()
+	if got := run("BACKUP", "backup"); got != "-ERR a backup is already in progress\r\n" {
+		t.Fatalf("second backup: got %q", got)
+	}
+	store.backup.Lock()
+	store.backup.running = false
+	store.backup.Unlock()
+
+	// a directory that cannot be used is refused right away
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if got := run("BACKUP", "file/backup"); got[0] != '-' {
+		t.Fatalf("backup under a file: got %q", got)
+	}
+	// and so is one outside of the backup directory
+	outside := t.TempDir()
+	for _, name := range []string{outside, "../" + filepath.Base(outside), "a/../../b", ""} {
+		if got := run("BACKUP", name); got != "-ERR backup directory must be a relative path within the backup directory\r\n" {
+			t.Fatalf("backup into %q: got %q", name, got)
+		}
+	}
+	if entries, err := os.ReadDir(outside); err != nil || len(entries) != 0 {
+		t.Fatalf("backup wrote outside of the backup directory: %v, %v", entries, err)
+	}
+
+	// Close waits for a backup still running
+	backup := filepath.Join(root, "backup")
+	if got := run("BACKUP", "backup"); got != "+Backup started\r\n" {
+		t.Fatalf("backup: got %q", got)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyCheckpoint(backup); err != nil {
+		t.Fatalf("backup cut short by Close: %v", err)
+	}
+}
+
+func TestCheckpointWhileRotating(t *testing.T) {
+	store := newTestStore(t, t.TempDir(), config.WithMaxDatafileSize(256))
+	defer store.Close()
+
+	// every few writes seal a datafile and start writing its hint file
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			if err := store.set(fmt.Sprintf("key%d", i%100), []byte("value")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; ; i++ {
+		dir := filepath.Join(t.TempDir(), "checkpoint")
+		if err := store.Checkpoint(dir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyCheckpoint(dir); err != nil {
+			t.Fatalf("checkpoint %d: %v", i, err)
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
@@ -6,61 +6,19 @@ import (
 
 type Cmd struct {
 	Cmd  string
-	Args []string
-}
-
-func evalValue(line string) string {
-	line = strings.TrimSpace(line)
-	var size = len(line)
-	if size == 0 {
-		return ""
-	}
-
-	var index = 0
-	var char uint8
-	switch line[0] {
-	case '\'':
-		char = '\''
-		if line[size-1] != char {
-			return ""
-		}
-		index = 1
-	case '"':
-		char = '"'
-		if line[size-1] != char {
-			return ""
-		}
-		index = 1
-	default:
-		char = ' '
-	}
-	for ; index < size; index++ {
-		if line[index] == char {
-			break
-		}
-	}
-
-	switch char {
-	case ' ':
-		if index == size {
-			return line
-		}
-		return ""
-	default:
-		if index != size-1 {
-			return ""
-		}
-		return line[1 : size-1]
-	}
+	Args [][]byte
 }
 
+// evalCmd returns the first argument of an inline command line and the index
+// just past it. An argument is either a run of non space characters or a
+// single or double quoted string. A zero index is returned when a quoted
+// argument is not terminated.
 func evalCmd(line string) (int, string) {
 	size := len(line)
 	if size == 0 {
 		return 0, ""
 	}
 
-	var cmd strings.Builder
 	var end = 0
 	var start = 0
 	var char uint8
@@ -81,7 +39,6 @@ func evalCmd(line string) (int, string) {
 			end++
 			break
 		}
-		cmd.WriteByte(line[end])
 	}
 
 	switch char {
@@ -91,48 +48,22 @@ func evalCmd(line string) (int, string) {
 		}
 		return end, line[start : end-1]
 	default:
-		if line[end-1] != char {
+		if end == start || line[end-1] != char {
 			return 0, ""
 		}
 		return end, line[start : end-1]
 	}
 }
 
-func NewCmd(line string) *Cmd {
-	line = strings.TrimSpace(line)
-	j, cmd := evalCmd(line)
-	if cmd == "" {
-		return nil
-	}
-	cmd = strings.ToUpper(cmd)
-	line = line[j:]
-	line = strings.TrimSpace(line)
-
-	k, key := evalCmd(line)
-	if key == "" && cmd != pingCmd {
-		return nil
-	}
-	line = line[k:]
-	line = strings.TrimSpace(line)
-
-	if cmd != setCmd {
-		if len(line) != 0 {
-			return nil
-		}
-
-		return &Cmd{
-			Cmd:  cmd,
-			Args: []string{key},
-		}
-	}
-
-	value := evalValue(line)
-	if value == "" {
+// NewCmd builds a command from decoded arguments, the first of which is the
+// command name. It returns nil when args is empty.
+func NewCmd(args [][]byte) *Cmd {
+	if len(args) == 0 {
 		return nil
 	}
 
 	return &Cmd{
-		Cmd:  cmd,
-		Args: []string{key, value},
+		Cmd:  strings.ToUpper(string(args[0])),
+		Args: args[1:],
 	}
 }
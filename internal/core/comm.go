@@ -1,7 +1,6 @@
 package core
 
 import (
-	"errors"
 	"io"
 	"syscall"
 )
@@ -17,21 +16,18 @@ func NewClient(fd int) *Client {
 	}
 }
 
+// Fd returns the socket the client is connected on.
+func (c *Client) Fd() int {
+	return c.fd
+}
+
 func (c *Client) Write(p []byte) (int, error) {
 	return syscall.Write(c.fd, p)
 }
 
+// Read reads whatever is available on the socket. The socket is non-blocking,
+// so syscall.EAGAIN is returned when there is nothing to read yet and the
+// caller should wait for it to become readable again.
 func (c *Client) Read(p []byte) (int, error) {
-	for {
-		n, err := syscall.Read(c.fd, p)
-		if err != nil {
-			var errno syscall.Errno
-			if errors.As(err, &errno) && (errno == syscall.EAGAIN || errno == syscall.EWOULDBLOCK) {
-				// EAGAIN or EWOULDBLOCK means no data available right now, try again
-				continue
-			}
-			return n, err // Return the result of the Read operation, even if it's an error
-		}
-		return n, err
-	}
+	return syscall.Read(c.fd, p)
 }
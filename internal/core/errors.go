@@ -0,0 +1,43 @@
+package core
+
+import "fmt"
+
+const (
+	ErrIncomplete  Error = "incomplete command"
+	ErrProtocol    Error = "ERR Protocol error"
+	ErrKeyNotFound Error = "key not found"
+	// ErrCorruptRecord is returned when a record read from a datafile fails
+	// its checksum.
+	ErrCorruptRecord Error = "corrupt record"
+	// ErrCorruptHint is returned when a hint file fails its checksum or does
+	// not match its datafile.
+	ErrCorruptHint Error = "corrupt hint file"
+	// ErrLocked is returned when the data directory is already open for
+	// writing in another process.
+	ErrLocked Error = "data directory is locked by another process"
+	// ErrReadOnly is returned by writes to a store opened read-only.
+	ErrReadOnly Error = "store is opened read-only"
+	// ErrSnapshotReleased is returned by reads from a released snapshot.
+	ErrSnapshotReleased Error = "snapshot is released"
+	// ErrNotEmpty is returned when a checkpoint is written to, or restored
+	// into, a directory that already holds files.
+	ErrNotEmpty Error = "directory is not empty"
+	// ErrCorruptCheckpoint is returned when the files of a checkpoint do not
+	// match its manifest.
+	ErrCorruptCheckpoint Error = "checkpoint does not match its manifest"
+)
+
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+func (e Error) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && string(e) == string(t)
+}
+
+func protocolError(msg string) error {
+	return fmt.Errorf("%w: %s", ErrProtocol, msg)
+}
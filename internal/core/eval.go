@@ -1,49 +1,427 @@
 package core
 
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
 const (
-	pingCmd = "PING"
-	setCmd  = "SET"
-	delCmd  = "DEL"
-	getCmd  = "GET"
+	pingCmd    = "PING"
+	setCmd     = "SET"
+	delCmd     = "DEL"
+	getCmd     = "GET"
+	expireCmd  = "EXPIRE"
+	pexpireCmd = "PEXPIRE"
+	ttlCmd     = "TTL"
+	pttlCmd    = "PTTL"
+	persistCmd = "PERSIST"
+	msetCmd    = "MSET"
+	multiCmd   = "MULTI"
+	execCmd    = "EXEC"
+	discardCmd = "DISCARD"
+	watchCmd   = "WATCH"
+	unwatchCmd = "UNWATCH"
+	scanCmd    = "SCAN"
+	keysCmd    = "KEYS"
+	backupCmd  = "BACKUP"
+	fsyncCmd   = "FSYNC"
 )
 
-func (s *Store) evalPing(key string) []byte {
-	msg := func() string {
-		if key == "" {
-			return "PONG"
+// keysBatch is the number of keys KEYS looks at while holding the store lock.
+const keysBatch = 1024
+
+var (
+	errInternal   = errors.New("ERR internal error")
+	errCorrupt    = errors.New("ERR corrupt record, the stored value failed its checksum")
+	errReadOnly   = errors.New("READONLY You can't write against a read only store")
+	errSyntax     = errors.New("ERR syntax error")
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+	errCursor     = errors.New("ERR invalid cursor")
+
+	errBackupNotEmpty = errors.New("ERR backup directory is not empty")
+	errBackupRunning  = errors.New("ERR a backup is already in progress")
+	errBackupPath     = errors.New("ERR backup directory must be a relative path within the backup directory")
+)
+
+func errWrongArgs(cmd string) error {
+	return fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))
+}
+
+func errInvalidExpire(cmd string) error {
+	return fmt.Errorf("ERR invalid expire time in '%s' command", strings.ToLower(cmd))
+}
+
+// parseExpiry parses a time to live counted in units of unit milliseconds
+// and returns the expiry it ends at. A time to live that is not positive
+// gives an expiry that has already passed.
+func parseExpiry(cmd string, arg []byte, unit int64) (uint64, error) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+
+	at := int64(now())
+	if n > (math.MaxInt64-at)/unit || n < -math.MaxInt64/unit {
+		return 0, errInvalidExpire(cmd)
+	}
+	at += n * unit
+	if at <= 0 {
+		at = 1
+	}
+	return uint64(at), nil
+}
+
+// encodeError turns an error from the store into an error reply. Details of
+// internal failures are logged by the store and not sent to the client.
+func encodeError(err error) []byte {
+	switch {
+	case errors.Is(err, ErrCorruptRecord):
+		return Encode(errCorrupt, false)
+	case errors.Is(err, ErrReadOnly):
+		return Encode(errReadOnly, false)
+	}
+	return Encode(errInternal, false)
+}
+
+func evalPing(args [][]byte) []byte {
+	switch len(args) {
+	case 0:
+		return Encode("PONG", true)
+	case 1:
+		return Encode(args[0], false)
+	default:
+		return Encode(errWrongArgs(pingCmd), false)
+	}
+}
+
+func evalGet(db keyspace, args [][]byte) []byte {
+	if len(args) != 1 {
+		return Encode(errWrongArgs(getCmd), false)
+	}
+
+	value, err := db.get(string(args[0]))
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return RESP_NIL
 		}
-		return key
-	}()
-	return Encode(msg)
+		return encodeError(err)
+	}
+	return Encode(value, false)
 }
 
-func (s *Store) evalGet(key string) []byte {
-	return Encode(s.get(key))
+// evalSet stores a value, optionally with a time to live given with EX in
+// seconds or PX in milliseconds. With SYNC it replies once the value is on
+// disk whatever the sync mode.
+func evalSet(db keyspace, args [][]byte) []byte {
+	if len(args) < 2 {
+		return Encode(errWrongArgs(setCmd), false)
+	}
+
+	var (
+		expiry uint64
+		sync   bool
+	)
+	for i := 2; i < len(args); i++ {
+		var unit int64
+		switch strings.ToUpper(string(args[i])) {
+		case "EX":
+			unit = 1000
+		case "PX":
+			unit = 1
+		case "SYNC":
+			sync = true
+			continue
+		default:
+			return Encode(errSyntax, false)
+		}
+		if expiry != 0 || i+1 == len(args) {
+			return Encode(errSyntax, false)
+		}
+
+		i++
+		var err error
+		if expiry, err = parseExpiry(setCmd, args[i], unit); err != nil {
+			return Encode(err, false)
+		}
+		if isExpired(expiry) {
+			return Encode(errInvalidExpire(setCmd), false)
+		}
+	}
+
+	if err := db.put(string(args[0]), args[1], expiry); err != nil {
+		return encodeError(err)
+	}
+	if sync {
+		if err := db.Sync(); err != nil {
+			return encodeError(err)
+		}
+	}
+	return RESP_OK
 }
 
-func (s *Store) evalSet(key, value string) []byte {
-	return Encode(s.set(key, []byte(value)))
+// evalFsync replies once every write acknowledged before it is on disk.
+func evalFsync(db keyspace, args [][]byte) []byte {
+	if len(args) != 0 {
+		return Encode(errWrongArgs(fsyncCmd), false)
+	}
+
+	if err := db.Sync(); err != nil {
+		return encodeError(err)
+	}
+	return RESP_OK
 }
 
-func (s *Store) evalDelete(key string) []byte {
-	return Encode(s.del(key))
+// evalMSet stores several values atomically.
+func evalMSet(db keyspace, args [][]byte) []byte {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return Encode(errWrongArgs(msetCmd), false)
+	}
+
+	var batch WriteBatch
+	for i := 0; i < len(args); i += 2 {
+		batch.Put(string(args[i]), args[i+1])
+	}
+	if err := db.Write(&batch); err != nil {
+		return encodeError(err)
+	}
+	return RESP_OK
 }
 
-func (s *Store) executeCmd(cmd *Cmd) []byte {
+// evalExpire sets the time to live of a key, counted in units of unit
+// milliseconds.
+func evalExpire(db keyspace, cmd string, args [][]byte, unit int64) []byte {
+	if len(args) != 2 {
+		return Encode(errWrongArgs(cmd), false)
+	}
+
+	expiry, err := parseExpiry(cmd, args[1], unit)
+	if err != nil {
+		return Encode(err, false)
+	}
+	_, ok, err := db.expire(string(args[0]), expiry)
+	if err != nil {
+		return encodeError(err)
+	}
+	if !ok {
+		return RESP_ZERO
+	}
+	return RESP_ONE
+}
+
+// evalTTL returns the time to live of a key in units of unit milliseconds,
+// -1 when it does not expire and -2 when it does not exist.
+func evalTTL(db keyspace, cmd string, args [][]byte, unit int64) []byte {
+	if len(args) != 1 {
+		return Encode(errWrongArgs(cmd), false)
+	}
+
+	ttl := db.ttl(string(args[0]))
+	if ttl < 0 {
+		return Encode(ttl, false)
+	}
+	return Encode((ttl+unit/2)/unit, false)
+}
+
+func evalPersist(db keyspace, args [][]byte) []byte {
+	if len(args) != 1 {
+		return Encode(errWrongArgs(persistCmd), false)
+	}
+
+	previous, ok, err := db.expire(string(args[0]), 0)
+	if err != nil {
+		return encodeError(err)
+	}
+	if !ok || previous == 0 {
+		return RESP_ZERO
+	}
+	return RESP_ONE
+}
+
+func evalDelete(db keyspace, args [][]byte) []byte {
+	if len(args) < 1 {
+		return Encode(errWrongArgs(delCmd), false)
+	}
+
+	deleted := 0
+	for _, key := range args {
+		ok, err := db.del(string(key))
+		if err != nil {
+			return encodeError(err)
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return Encode(deleted, false)
+}
+
+// evalKeys returns every key matching a glob pattern. Only the keys starting
+// with the literal prefix of the pattern are looked at.
+func evalKeys(db keyspace, args [][]byte) []byte {
+	if len(args) != 1 {
+		return Encode(errWrongArgs(keysCmd), false)
+	}
+
+	pattern := string(args[0])
+	match := func(key string) bool {
+		return matchPattern(pattern, key)
+	}
+	prefix := patternPrefix(pattern)
+	end := prefixEnd(prefix)
+
+	keys := []string{}
+	for from := prefix; ; {
+		batch, next := db.keys(from, end, keysBatch, match)
+		keys = append(keys, batch...)
+		if next == "" {
+			break
+		}
+		from = next
+	}
+	return Encode(keys, false)
+}
+
+// evalScan returns a page of keys and the cursor of the next one, 0 once the
+// scan is done. COUNT sets the number of keys looked at, MATCH keeps only the
+// keys matching a glob pattern.
+func evalScan(db keyspace, args [][]byte) []byte {
+	if len(args) < 1 || len(args)%2 != 1 {
+		return Encode(errWrongArgs(scanCmd), false)
+	}
+
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return Encode(errCursor, false)
+	}
+	count := 10
+	pattern := "*"
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(string(args[i])) {
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return Encode(errNotInteger, false)
+			}
+			if n < 1 {
+				return Encode(errSyntax, false)
+			}
+			count = n
+		case "MATCH":
+			pattern = string(args[i+1])
+		default:
+			return Encode(errSyntax, false)
+		}
+	}
+
+	prefix := patternPrefix(pattern)
+	from := prefix
+	if cursor != 0 {
+		key, ok := db.cursors().get(cursor)
+		if !ok {
+			return Encode(errCursor, false)
+		}
+		from = max(from, key)
+	}
+
+	var match func(key string) bool
+	if pattern != "*" {
+		match = func(key string) bool {
+			return matchPattern(pattern, key)
+		}
+	}
+	keys, next := db.keys(from, prefixEnd(prefix), count, match)
+
+	cursor = 0
+	if next != "" {
+		cursor = db.cursors().add(next)
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	return Encode([]interface{}{strconv.FormatUint(cursor, 10), keys}, false)
+}
+
+// evalBackup starts writing a checkpoint of the store into the directory
+// given, within the backup directory, in the background, see
+// Store.Checkpoint, and replies right away.
+// BACKUP STATUS reports how the last backup is doing.
+func (s *Store) evalBackup(args [][]byte) []byte {
+	if len(args) != 1 {
+		return Encode(errWrongArgs(backupCmd), false)
+	}
+	if strings.EqualFold(string(args[0]), "STATUS") {
+		return Encode(s.backupStatus(), false)
+	}
+
+	if err := s.startBackup(string(args[0])); err != nil {
+		switch {
+		case errors.Is(err, ErrNotEmpty):
+			return Encode(errBackupNotEmpty, false)
+		case errors.Is(err, errBackupRunning), errors.Is(err, errBackupPath):
+			return Encode(err, false)
+		}
+		return encodeError(err)
+	}
+	return Encode("Backup started", true)
+}
+
+// isCommand reports whether name is a command that runs against a keyspace.
+func isCommand(name string) bool {
+	switch name {
+	case pingCmd, getCmd, setCmd, delCmd, msetCmd, expireCmd, pexpireCmd, ttlCmd, pttlCmd, persistCmd, scanCmd, keysCmd, fsyncCmd:
+		return true
+	}
+	return false
+}
+
+func errUnknownCmd(name string) error {
+	return fmt.Errorf("ERR unknown command '%s'", strings.ToLower(name))
+}
+
+// executeCmd runs cmd against db.
+func executeCmd(db keyspace, cmd *Cmd) []byte {
 	switch cmd.Cmd {
 	case pingCmd:
-		return s.evalPing(cmd.Args[0])
+		return evalPing(cmd.Args)
 	case getCmd:
-		return s.evalGet(cmd.Args[0])
+		return evalGet(db, cmd.Args)
 	case setCmd:
-		return s.evalSet(cmd.Args[0], cmd.Args[1])
+		return evalSet(db, cmd.Args)
 	case delCmd:
-		return s.evalDelete(cmd.Args[0])
+		return evalDelete(db, cmd.Args)
+	case msetCmd:
+		return evalMSet(db, cmd.Args)
+	case expireCmd:
+		return evalExpire(db, expireCmd, cmd.Args, 1000)
+	case pexpireCmd:
+		return evalExpire(db, pexpireCmd, cmd.Args, 1)
+	case ttlCmd:
+		return evalTTL(db, ttlCmd, cmd.Args, 1000)
+	case pttlCmd:
+		return evalTTL(db, pttlCmd, cmd.Args, 1)
+	case persistCmd:
+		return evalPersist(db, cmd.Args)
+	case keysCmd:
+		return evalKeys(db, cmd.Args)
+	case scanCmd:
+		return evalScan(db, cmd.Args)
+	case fsyncCmd:
+		return evalFsync(db, cmd.Args)
 	default:
-		return s.evalPing(cmd.Args[0])
+		return Encode(errUnknownCmd(cmd.Cmd), false)
 	}
 }
 
-func (s *Store) EvalAndResponse(cmd *Cmd, client *Client) {
-	_, _ = client.Write(s.executeCmd(cmd))
+func (s *Store) executeCmd(cmd *Cmd) []byte {
+	return executeCmd(s.NewSession().db, cmd)
+}
+
+// EvalAndResponse runs cmds in order in a session of their own and writes all
+// of their replies to w in a single write.
+func (s *Store) EvalAndResponse(cmds []*Cmd, w io.Writer) {
+	s.NewSession().EvalAndResponse(cmds, w)
 }
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// sweepSample is the number of keys with an expiry the sweeper looks at
+	// while holding the store lock.
+	sweepSample = 20
+	// sweepLimit is the most keys the sweeper looks at in one go.
+	sweepLimit = 1024
+)
+
+// expire sets the expiry of key, zero making it persistent, by writing its
+// value again with the new expiry. An expiry that has already passed deletes
+// the key. It returns the expiry the key had before and whether it exists.
+func (s *Store) expire(key string, expiry uint64) (uint64, bool, error) {
+	prev, existed, seq, err := s.setExpiry(key, expiry)
+	if err != nil || !existed {
+		return 0, false, err
+	}
+	return prev, true, s.waitDurable(seq)
+}
+
+// setExpiry sets the expiry of key like expire without waiting for a sync. It
+// also returns the count of appends the write is part of.
+func (s *Store) setExpiry(key string, expiry uint64) (uint64, bool, uint64, error) {
+	if s.cfg.ReadOnly {
+		return 0, false, 0, ErrReadOnly
+	}
+
+	if isExpired(expiry) {
+		meta, ok := s.peek(key)
+		if !ok {
+			return 0, false, 0, nil
+		}
+		_, seq, err := s.writeRecord(newRecord(key, nil, recordTombstone, 0))
+		if err != nil {
+			return 0, false, 0, err
+		}
+		return meta.Expiry, true, seq, nil
+	}
+
+	// the value is read back under the lock so a concurrent write to the key
+	// cannot slip in between
+	s.Lock()
+	prev, existed, err := s.rewriteExpiry(key, expiry)
+	seq := s.appends
+	s.Unlock()
+	if err != nil || !existed {
+		return 0, false, 0, err
+	}
+	return prev, true, seq, nil
+}
+
+// rewriteExpiry writes the value of key again with the new expiry, unless it
+// already has it. It returns the expiry key had before and whether it exists.
+// The caller must hold the store lock.
+func (s *Store) rewriteExpiry(key string, expiry uint64) (uint64, bool, error) {
+	meta, ok := s.lookup(key)
+	if !ok {
+		return 0, false, nil
+	}
+	if meta.Expiry == expiry {
+		return meta.Expiry, true, nil
+	}
+
+	buffer := s.BufferPool.Get().(*bytes.Buffer)
+	defer s.BufferPool.Put(buffer)
+	defer buffer.Reset()
+
+	object, err := s.FileDir[meta.FileId].Read(meta.Offset, meta.ObjectSize)
+	if err != nil {
+		const msg = "failed to read data file"
+		s.Log.Error(msg, zap.Error(err))
+		return 0, false, fmt.Errorf(msg+": %w", err)
+	}
+	record, err := s.decodeObject(key, meta, object)
+	if err != nil {
+		return 0, false, err
+	}
+
+	record = newRecord(key, record.Value, recordValue, expiry)
+	if err := record.encode(buffer); err != nil {
+		const msg = "unable to encode record"
+		s.Log.Error(msg, zap.Error(err))
+		return 0, false, fmt.Errorf(msg+": %w", err)
+	}
+	if _, err := s.appendRecord(record, buffer.Bytes()); err != nil {
+		return 0, false, err
+	}
+
+	return meta.Expiry, true, nil
+}
+
+// ttl returns the time left before key expires in milliseconds, -1 when the
+// key does not expire and -2 when it does not exist.
+func (s *Store) ttl(key string) int64 {
+	meta, ok := s.peek(key)
+	switch {
+	case !ok:
+		return -2
+	case meta.Expiry == 0:
+		return -1
+	}
+	return timeLeft(meta.Expiry)
+}
+
+// timeLeft returns the milliseconds left before expiry, -2 once it passed.
+// The clock is read once, so a key expiring meanwhile cannot wrap around.
+func timeLeft(expiry uint64) int64 {
+	t := now()
+	if expiry <= t {
+		return -2
+	}
+	return int64(expiry - t)
+}
+
+// ExpireKeys removes expired keys from the key directory every
+// ExpireInterval, so keys nobody reads again do not hold on to memory.
+func (s *Store) ExpireKeys(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(s.cfg.ExpireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.Log.Info("canceling expiry sweep")
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// sweep removes expired keys from the key directory the way Redis does: it
+// looks at a random sample of the keys with an expiry and takes another one
+// while more than a quarter of the sample had expired, up to sweepLimit keys.
+// Samples are taken under the locks of the key directory shards and the store
+// lock is only held to check one of them, so readers and writers are never
+// held up for long however many keys have an expiry.
+func (s *Store) sweep() int {
+	expired := 0
+	for seen := 0; seen < sweepLimit; {
+		sample := min(sweepSample, sweepLimit-seen)
+		keys := s.KeyDir.SampleExpiring(sample)
+		n := 0
+		s.Lock()
+		for _, key := range keys {
+			if meta, ok := s.KeyDir.Get(key); ok && isExpired(meta.Expiry) {
+				s.expireMeta(key)
+				n++
+			}
+		}
+		s.Unlock()
+		expired += n
+		seen += len(keys)
+		if len(keys) < sample || n*4 <= len(keys) {
+			break
+		}
+	}
+
+	if expired > 0 {
+		s.Log.Debug("removed expired keys", zap.Int("keys", expired))
+	}
+	return expired
+}
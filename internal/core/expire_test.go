@@ -0,0 +1,151 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpireCommands(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+	defer store.Close()
+
+	run := func(args ...string) string {
+		b := make([][]byte, len(args))
+		for i, arg := range args {
+			b[i] = []byte(arg)
+		}
+		return string(store.executeCmd(NewCmd(b)))
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "session", "data", "EX", "100"}, "+OK\r\n"},
+		{[]string{"TTL", "session"}, ":100\r\n"},
+		{[]string{"PERSIST", "session"}, ":1\r\n"},
+		{[]string{"PERSIST", "session"}, ":0\r\n"},
+		{[]string{"TTL", "session"}, ":-1\r\n"},
+		{[]string{"PEXPIRE", "session", "5000"}, ":1\r\n"},
+		{[]string{"TTL", "session"}, ":5\r\n"},
+		{[]string{"GET", "session"}, "$4\r\ndata\r\n"},
+		{[]string{"SET", "session", "new"}, "+OK\r\n"},
+		{[]string{"TTL", "session"}, ":-1\r\n"},
+		{[]string{"EXPIRE", "session", "0"}, ":1\r\n"},
+		{[]string{"GET", "session"}, "$-1\r\n"},
+		{[]string{"TTL", "session"}, ":-2\r\n"},
+		{[]string{"EXPIRE", "session", "10"}, ":0\r\n"},
+		{[]string{"SET", "session", "data", "PX", "0"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "session", "data", "EX", "ten"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"SET", "session", "data", "EX"}, "-ERR syntax error\r\n"},
+		{[]string{"SET", "session", "data", "EX", "1", "PX", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"EXPIRE", "session", "9223372036854775807"}, "-ERR invalid expire time in 'expire' command\r\n"},
+	} {
+		if got := run(tc.args...); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestTimeLeft(t *testing.T) {
+	at := now()
+	for _, expiry := range []uint64{1, at - 1, at} {
+		if got := timeLeft(expiry); got != -2 {
+			t.Errorf("time left before %d at %d: got %d, want -2", expiry, at, got)
+		}
+	}
+	if got := timeLeft(at + 60_000); got <= 0 || got > 60_000 {
+		t.Errorf("time left a minute ahead: got %d", got)
+	}
+}
+
+func TestExpiryAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir)
+
+	// an expired value hides the value written before it
+	if err := store.set("expired", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.put("expired", []byte("new"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.put("alive", []byte("value"), now()+3600_000); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(store *Store) {
+		t.Helper()
+		if _, err := store.get("expired"); err != ErrKeyNotFound {
+			t.Fatalf("get expired: got %v, want ErrKeyNotFound", err)
+		}
+		if ttl := store.ttl("alive"); ttl <= 0 || ttl > 3600_000 {
+			t.Fatalf("ttl alive: got %d", ttl)
+		}
+	}
+	check(store)
+
+	// the first restart scans the datafile, the second reads its hint file
+	for i := 0; i < 2; i++ {
+		store.Lock()
+		if err := store.updateActiveDatafile(store.FileId + 1); err != nil {
+			t.Fatal(err)
+		}
+		store.Unlock()
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+		store = newTestStore(t, dir)
+		check(store)
+	}
+	defer store.Close()
+
+	if _, err := os.Stat(GetHintFile(filepath.Join(dir, ".data"), 1)); err != nil {
+		t.Fatalf("expected a hint file: %v", err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+	defer store.Close()
+
+	for i := 0; i < 3*sweepLimit; i++ {
+		expiry := uint64(1)
+		if i%3 == 0 {
+			expiry = 0
+		}
+		if err := store.put(fmt.Sprintf("key%d", i), []byte("value"), expiry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a sweep looks at no more than sweepLimit keys, the next one goes on
+	// while most of its sample is expired
+	if n := store.sweep(); n == 0 || n > sweepLimit {
+		t.Fatalf("swept %d keys, want at most %d", n, sweepLimit)
+	}
+	for store.sweep() > 0 {
+	}
+	if expiring := store.KeyDir.SampleExpiring(3 * sweepLimit); store.KeyDir.Len() != sweepLimit || len(expiring) != 0 {
+		t.Fatalf("got %d keys and %d expiring after the sweep", store.KeyDir.Len(), len(expiring))
+	}
+
+	// keys that expire later stop a sweep after its first sample
+	for i := 0; i < sweepLimit; i++ {
+		if err := store.put(fmt.Sprintf("later%d", i), []byte("value"), now()+uint64(time.Hour.Milliseconds())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.put("expired", []byte("value"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.sweep(); n > 1 {
+		t.Fatalf("swept %d keys, only one has expired", n)
+	}
+	if dead := store.deadBytes(store.FileId); dead != 0 {
+		t.Fatalf("expired values should be accounted as tombstones, got %d dead bytes", dead)
+	}
+}
@@ -0,0 +1,250 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+	"go.uber.org/zap"
+)
+
+// groupCommit lets concurrent durable writers share a sync. A writer appends
+// under the store lock, then waits outside it until the active datafile is
+// synced past its append. One of the waiters syncs for all of them, and the
+// writers that append meanwhile wait for the next sync, so the syncs a second
+// are bounded by the disk rather than by the writers. Writes that ask to be
+// synced wait the same way whatever the sync mode.
+type groupCommit struct {
+	// maxWait is how long a sync waits for more writers before it starts,
+	// maxBatch the number of waiting writers that starts it early.
+	maxWait  time.Duration
+	maxBatch int
+	kick     chan struct{}
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// syncing is set while a waiter syncs, waiting counts the writers that
+	// wait for a sync.
+	syncing bool
+	waiting int
+	// synced is the count of appends known to be on disk. The appends after
+	// failedFrom up to failed may not be, their sync failed with err. That
+	// is not undone by a later sync, the failed writes may be lost.
+	synced     uint64
+	failedFrom uint64
+	failed     uint64
+	err        error
+	// syncs counts the syncs done.
+	syncs int
+}
+
+// newGroupCommit returns the groupCommit for cfg. Syncs only wait for more
+// writers when group commit is on.
+func newGroupCommit(cfg config.Config) *groupCommit {
+	g := &groupCommit{kick: make(chan struct{}, 1)}
+	if cfg.GroupCommit {
+		g.maxWait, g.maxBatch = cfg.GroupCommitWait, cfg.GroupCommitSize
+	}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// grouped reports whether every write waits for a shared sync.
+func (s *Store) grouped() bool {
+	return s.cfg.Sync == config.SyncEveryWrite && s.cfg.GroupCommit
+}
+
+// markSynced records that the first seq appends are on disk.
+func (g *groupCommit) markSynced(seq uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.synced = max(g.synced, seq)
+}
+
+// markFailed records that the first seq appends may not be on disk, their
+// sync failed with err.
+func (g *groupCommit) markFailed(seq uint64, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.fail(seq, err)
+	g.cond.Broadcast()
+}
+
+// fail records a failed sync like markFailed. The appends known to be on
+// disk are not affected. Failures close together are recorded as one, which
+// may fail writes in between that did reach the disk but never acknowledges
+// one that did not. The caller must hold g.mu.
+func (g *groupCommit) fail(seq uint64, err error) {
+	if seq <= g.synced {
+		return
+	}
+	if g.err == nil {
+		g.failedFrom = g.synced
+	}
+	g.failed, g.err = max(g.failed, seq), err
+}
+
+// failedAt reports whether the sync of append seq failed. The caller must
+// hold g.mu.
+func (g *groupCommit) failedAt(seq uint64) bool {
+	return g.err != nil && seq > g.failedFrom && seq <= g.failed
+}
+
+// waitDurable returns once the first seq appends are as durable as the sync
+// mode asks for. Only group commit leaves a write to sync after the store
+// lock is released.
+func (s *Store) waitDurable(seq uint64) error {
+	if !s.grouped() {
+		return nil
+	}
+	return s.WaitSynced(seq)
+}
+
+// WaitSynced returns once the first seq appends are on disk, or with the
+// error their sync failed with.
+func (s *Store) WaitSynced(seq uint64) error {
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.waiting++
+	defer func() { g.waiting-- }()
+	if g.syncing && g.maxBatch > 0 && g.waiting >= g.maxBatch {
+		select {
+		case g.kick <- struct{}{}:
+		default:
+		}
+	}
+
+	for !g.failedAt(seq) {
+		if g.synced >= seq {
+			return nil
+		}
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		g.syncing = true
+		crowd := g.maxBatch > 0 && g.waiting >= g.maxBatch
+		g.mu.Unlock()
+		target, err := s.syncAppended(crowd)
+		g.mu.Lock()
+		g.syncing = false
+		g.syncs++
+		if err != nil {
+			g.fail(target, err)
+		} else {
+			g.synced = max(g.synced, target)
+		}
+		g.cond.Broadcast()
+	}
+	return g.err
+}
+
+// Syncs returns the count of syncs writers waited on, for monitoring.
+func (s *Store) Syncs() int {
+	g := s.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.syncs
+}
+
+// syncAppended syncs the active datafile and returns the count of appends it
+// covers. Unless crowd is set it first gives other writers up to maxWait to
+// append, or until enough of them wait.
+func (s *Store) syncAppended(crowd bool) (uint64, error) {
+	g := s.group
+	if g.maxWait > 0 && !crowd {
+		timer := time.NewTimer(g.maxWait)
+		select {
+		case <-timer.C:
+		case <-g.kick:
+		}
+		timer.Stop()
+	}
+
+	s.Lock()
+	df, target := s.dataFile, s.appends
+	s.Unlock()
+	if err := df.SyncData(); err != nil {
+		s.Lock()
+		rotated := s.dataFile != df
+		s.Unlock()
+		if rotated {
+			// sealing the datafile synced it and recorded how that went
+			return 0, nil
+		}
+		const msg = "unable to sync active datafile"
+		s.Log.Error(msg, zap.Error(err))
+		return target, fmt.Errorf(msg+": %w", err)
+	}
+	return target, nil
+}
+
+// deferredStore is the store as seen by a session that defers syncs. Writes
+// do not wait for a sync, they record the appends the session's replies must
+// wait for instead.
+type deferredStore struct {
+	sessionDB
+}
+
+// await has the session's replies wait until the first seq appends are on
+// disk.
+func (d deferredStore) await(seq uint64) {
+	d.session.unsynced = max(d.session.unsynced, seq)
+}
+
+// awaitDurable has the session's replies wait for the first seq appends as
+// the sync mode asks for, see waitDurable.
+func (d deferredStore) awaitDurable(seq uint64) {
+	if d.grouped() {
+		d.await(seq)
+	}
+}
+
+func (d deferredStore) put(key string, value []byte, expiry uint64) error {
+	_, seq, err := d.writeRecord(newRecord(key, value, recordValue, expiry))
+	d.awaitDurable(seq)
+	return err
+}
+
+func (d deferredStore) del(key string) (bool, error) {
+	if _, ok := d.peek(key); !ok {
+		return false, nil
+	}
+	existed, seq, err := d.writeRecord(newRecord(key, nil, recordTombstone, 0))
+	d.awaitDurable(seq)
+	return existed, err
+}
+
+func (d deferredStore) Write(b *WriteBatch) error {
+	_, err := d.commit(b, nil)
+	return err
+}
+
+func (d deferredStore) commit(b *WriteBatch, watched map[string]uint64) (bool, error) {
+	ok, seq, err := d.commitBatch(b, watched)
+	d.awaitDurable(seq)
+	return ok, err
+}
+
+func (d deferredStore) transact(watched map[string]uint64, build func() *WriteBatch) (bool, error) {
+	ok, seq, err := d.transactBatch(watched, build)
+	d.awaitDurable(seq)
+	return ok, err
+}
+
+func (d deferredStore) expire(key string, expiry uint64) (uint64, bool, error) {
+	prev, existed, seq, err := d.setExpiry(key, expiry)
+	d.awaitDurable(seq)
+	return prev, existed, err
+}
+
+// Sync has the session's replies wait for every append so far.
+func (d deferredStore) Sync() error {
+	if !d.cfg.ReadOnly {
+		d.await(d.appendCount())
+	}
+	return nil
+}
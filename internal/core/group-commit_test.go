@@ -0,0 +1,316 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+	"github.com/ajaxchavan/bytecask/internal/datafile"
+)
+
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	opts := []config.OptFunc{
+		config.WithFsync(true),
+		config.WithGroupCommit(true),
+		config.WithGroupCommitWait(time.Millisecond),
+		config.WithGroupCommitSize(4),
+		config.WithMaxDatafileSize(4096),
+	}
+	store := newTestStore(t, dir, opts...)
+
+	const writers, writes = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := fmt.Sprintf("w%d:%03d", w, i)
+				var err error
+				switch i % 3 {
+				case 0:
+					err = store.set(key, []byte(strconv.Itoa(i)))
+				case 1:
+					var b WriteBatch
+					b.Put(key, []byte(strconv.Itoa(i)))
+					err = store.Write(&b)
+				case 2:
+					if err = store.set(key, []byte(strconv.Itoa(i))); err == nil {
+						_, _, err = store.expire(key, uint64(time.Now().Add(time.Hour).UnixMilli()))
+					}
+				}
+				if err != nil {
+					t.Errorf("write %s: %v", key, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if syncs := store.group.syncs; syncs >= writers*writes {
+		t.Errorf("got %d syncs for %d writes", syncs, writers*writes)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = newTestStore(t, dir, opts...)
+	defer store.Close()
+	for w := 0; w < writers; w++ {
+		for i := 0; i < writes; i++ {
+			key := fmt.Sprintf("w%d:%03d", w, i)
+			if got, err := store.get(key); err != nil || string(got) != strconv.Itoa(i) {
+				t.Fatalf("get %s: got %q, %v", key, got, err)
+			}
+		}
+	}
+}
+
+func TestSyncModes(t *testing.T) {
+	// synced returns the count of appends known to be on disk
+	synced := func(store *Store) uint64 {
+		store.group.mu.Lock()
+		defer store.group.mu.Unlock()
+		return store.group.synced
+	}
+
+	t.Run("never", func(t *testing.T) {
+		store := newTestStore(t, t.TempDir(), config.WithSyncMode(config.SyncNever))
+		defer store.Close()
+		run := sessionRunner(store.NewSession())
+
+		for _, tc := range []struct {
+			args []string
+			want string
+		}{
+			{[]string{"SET", "a", "1"}, "+OK\r\n"},
+			{[]string{"SET", "b", "2", "EX"}, "-ERR syntax error\r\n"},
+			{[]string{"FSYNC", "now"}, "-ERR wrong number of arguments for 'fsync' command\r\n"},
+		} {
+			if got := run(tc.args...); got != tc.want {
+				t.Errorf("%q: got %q, want %q", tc.args, got, tc.want)
+			}
+		}
+		if got := synced(store); got != 0 {
+			t.Fatalf("got %d appends synced, want 0", got)
+		}
+
+		for _, cmds := range [][][]string{
+			{{"SET", "b", "2", "SYNC", "EX", "100"}},
+			{{"SET", "c", "3"}, {"FSYNC"}},
+			{{"MULTI"}, {"SET", "d", "4", "SYNC"}, {"EXEC"}},
+		} {
+			for _, args := range cmds {
+				run(args...)
+			}
+			if got, want := synced(store), store.appends; got != want {
+				t.Fatalf("%q: got %d appends synced, want %d", cmds, got, want)
+			}
+		}
+		if got := run("TTL", "b"); got != ":100\r\n" {
+			t.Fatalf("TTL b: got %q", got)
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		store := newTestStore(t, t.TempDir(), config.WithSyncMode(config.SyncEveryBytes), config.WithSyncBytes(1024))
+		defer store.Close()
+
+		value := make([]byte, 100)
+		for i := 0; i < 30; i++ {
+			if err := store.set("key", value); err != nil {
+				t.Fatal(err)
+			}
+			if store.unsynced >= 1024 {
+				t.Fatalf("%d bytes unsynced after write %d", store.unsynced, i)
+			}
+		}
+		if got := synced(store); got == 0 || got == store.appends {
+			t.Fatalf("got %d of %d appends synced", got, store.appends)
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		store := newTestStore(t, t.TempDir(), config.WithSyncInterval(10*time.Millisecond))
+		defer store.Close()
+
+		if err := store.set("key", []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if got := synced(store); got != 0 {
+			t.Fatalf("got %d appends synced before the interval", got)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go store.AsyncFlush(ctx, &wg)
+		defer wg.Wait()
+		defer cancel()
+		for deadline := time.Now().Add(5 * time.Second); synced(store) != 1; {
+			if time.Now().After(deadline) {
+				t.Fatal("the append was not synced within the interval")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("always", func(t *testing.T) {
+		store := newTestStore(t, t.TempDir(), config.WithSyncMode(config.SyncEveryWrite))
+		defer store.Close()
+
+		for i := 0; i < 3; i++ {
+			if err := store.set("key", []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			if got := synced(store); got != store.appends {
+				t.Fatalf("got %d of %d appends synced", got, store.appends)
+			}
+		}
+	})
+}
+
+func TestSyncFailure(t *testing.T) {
+	for _, group := range []bool{false, true} {
+		t.Run(fmt.Sprintf("group=%v", group), func(t *testing.T) {
+			dir := t.TempDir()
+			store := newTestStore(t, dir, config.WithSyncMode(config.SyncEveryWrite), config.WithGroupCommit(group))
+			defer store.Close()
+
+			// a pipe takes writes but cannot be synced
+			fifo := filepath.Join(dir, "fifo")
+			if err := syscall.Mkfifo(fifo, 0666); err != nil {
+				t.Skipf("no named pipes: %v", err)
+			}
+			reader, err := os.OpenFile(fifo, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			df, err := datafile.New(fifo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Lock()
+			active := store.dataFile
+			store.dataFile, store.FileDir[store.FileId] = df, df
+			store.Unlock()
+			defer active.Close()
+
+			if err := store.set("key", []byte("value")); err == nil {
+				t.Fatal("a write whose sync failed was acknowledged")
+			}
+			var b WriteBatch
+			b.Put("key", []byte("value"))
+			if err := store.Write(&b); err == nil {
+				t.Fatal("a batch whose sync failed was acknowledged")
+			}
+
+			// sealing the datafile fails to sync it as well, the writes
+			// are still not acknowledged once writes moved on
+			store.Lock()
+			err = store.updateActiveDatafile(store.FileId + 1)
+			store.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Sync(); err == nil {
+				t.Fatal("writes to a datafile that failed to seal were acknowledged")
+			}
+			if err := store.set("key", []byte("value")); err != nil {
+				t.Fatalf("write to the new datafile: %v", err)
+			}
+		})
+	}
+}
+
+// BenchmarkGroupCommit writes from every goroutine with a sync per write and
+// with group commit. Compare them with
+//
+//	go test ./internal/core -run '^$' -bench GroupCommit -cpu 1,8,64
+func BenchmarkGroupCommit(b *testing.B) {
+	value := make([]byte, 64)
+	for _, tc := range []struct {
+		name  string
+		group bool
+		wait  time.Duration
+	}{{"fsync", false, 0}, {"group", true, 0}, {"group/wait=1ms", true, time.Millisecond}} {
+		b.Run(tc.name, func(b *testing.B) {
+			store := newTestStore(b, b.TempDir(),
+				config.WithFsync(true),
+				config.WithGroupCommit(tc.group),
+				config.WithGroupCommitWait(tc.wait),
+			)
+			defer store.Close()
+
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if err := store.set("key:"+strconv.Itoa(i%1024), value); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestDeferSyncs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []config.OptFunc
+		cmds [][]string
+		wait bool
+	}{
+		{"never", []config.OptFunc{config.WithSyncMode(config.SyncNever)}, [][]string{{"SET", "a", "1"}}, false},
+		{"sync", []config.OptFunc{config.WithSyncMode(config.SyncNever)}, [][]string{{"SET", "a", "1", "SYNC"}}, true},
+		{"fsync", []config.OptFunc{config.WithSyncMode(config.SyncNever)}, [][]string{{"SET", "a", "1"}, {"FSYNC"}}, true},
+		{"multi", []config.OptFunc{config.WithSyncMode(config.SyncNever)}, [][]string{{"MULTI"}, {"SET", "a", "1", "SYNC"}, {"EXEC"}}, true},
+		{"grouped", []config.OptFunc{config.WithSyncMode(config.SyncEveryWrite), config.WithGroupCommit(true)}, [][]string{{"SET", "a", "1"}, {"DEL", "a"}}, true},
+		{"grouped read", []config.OptFunc{config.WithSyncMode(config.SyncEveryWrite), config.WithGroupCommit(true)}, [][]string{{"GET", "a"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newTestStore(t, t.TempDir(), tc.opts...)
+			defer store.Close()
+			session := store.NewSession()
+			session.DeferSyncs()
+			run := sessionRunner(session)
+
+			for _, args := range tc.cmds {
+				if got := run(args...); got[0] == '-' {
+					t.Fatalf("%q: got %q", args, got)
+				}
+			}
+			seq := session.Unsynced()
+			if !tc.wait {
+				if seq != 0 {
+					t.Fatalf("got replies waiting for %d appends, want none", seq)
+				}
+				return
+			}
+			if seq != store.appends {
+				t.Fatalf("got replies waiting for %d appends, want %d", seq, store.appends)
+			}
+			if syncs := store.Syncs(); syncs != 0 {
+				t.Fatalf("got %d syncs before waiting", syncs)
+			}
+			if err := store.WaitSynced(seq); err != nil {
+				t.Fatal(err)
+			}
+			if got := session.Unsynced(); got != 0 {
+				t.Fatalf("got replies waiting for %d appends after Unsynced", got)
+			}
+		})
+	}
+}
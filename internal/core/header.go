@@ -3,14 +3,51 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 )
 
+// crcSize is the size of the Crc field, which leads the encoded header and
+// is the only part of a record its checksum does not cover.
+const crcSize = 4
+
+// recordType tells what a record stands for.
+type recordType uint8
+
+const (
+	// recordValue stores a value for its key.
+	recordValue recordType = iota
+	// recordTombstone marks its key as deleted, it has no value.
+	recordTombstone
+	// recordBatchBegin and recordBatchCommit enclose the records of a batch.
+	// They have no key, their value holds the number of records in the batch.
+	recordBatchBegin
+	recordBatchCommit
+)
+
+func (t recordType) String() string {
+	switch t {
+	case recordValue:
+		return "value"
+	case recordTombstone:
+		return "tombstone"
+	case recordBatchBegin:
+		return "batch-begin"
+	case recordBatchCommit:
+		return "batch-commit"
+	}
+	return fmt.Sprintf("type-%d", uint8(t))
+}
+
 type Header struct {
 	Crc       uint32
 	Timestamp uint32
-	KeySize   uint32
-	ValSize   uint32
+	// Expiry is the unix time in milliseconds the value expires at, zero
+	// when it does not expire.
+	Expiry  uint64
+	KeySize uint32
+	ValSize uint32
+	Type    recordType
 }
 
 type Record struct {
@@ -27,6 +64,55 @@ func (h *Header) decode(record []byte) error {
 	return binary.Read(bytes.NewReader(record), binary.BigEndian, h)
 }
 
-func (r *Record) isValidCheckSum() bool {
-	return crc32.ChecksumIEEE(r.Value) == r.Crc
+// encode appends the record to buffer and fills in its checksum, which covers
+// the rest of the header, the key and the value.
+func (r *Record) encode(buffer *bytes.Buffer) error {
+	start := buffer.Len()
+	if err := r.Header.encode(buffer); err != nil {
+		return err
+	}
+	buffer.WriteString(r.Key)
+	buffer.Write(r.Value)
+
+	object := buffer.Bytes()[start:]
+	r.Crc = checksum(object)
+	binary.BigEndian.PutUint32(object, r.Crc)
+	return nil
+}
+
+// decodeRecord decodes an object read from a datafile and verifies its
+// checksum. ErrCorruptRecord is returned when the object does not hold a
+// whole record or its checksum does not match.
+func decodeRecord(object []byte) (*Record, error) {
+	if len(object) < int(headerSize) {
+		return nil, ErrCorruptRecord
+	}
+
+	r := &Record{}
+	if err := r.Header.decode(object); err != nil {
+		return nil, err
+	}
+	if uint64(len(object)) != uint64(headerSize)+uint64(r.KeySize)+uint64(r.ValSize) {
+		return nil, ErrCorruptRecord
+	}
+	if !r.isValidCheckSum(object) {
+		return nil, ErrCorruptRecord
+	}
+
+	r.Key = string(object[headerSize : headerSize+r.KeySize])
+	r.Value = object[headerSize+r.KeySize:]
+	return r, nil
+}
+
+// size returns the number of bytes the record takes up in a datafile.
+func (r *Record) size() uint32 {
+	return headerSize + r.KeySize + r.ValSize
+}
+
+func (r *Record) isValidCheckSum(object []byte) bool {
+	return checksum(object) == r.Crc
+}
+
+func checksum(object []byte) uint32 {
+	return crc32.ChecksumIEEE(object[crcSize:])
 }
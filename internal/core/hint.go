@@ -0,0 +1,287 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/ajaxchavan/bytecask/internal/datafile"
+)
+
+const (
+	// hintEntryHeaderSize is the size of the fixed part of a hint entry:
+	// timestamp, key size, object size, offset, record type and expiry.
+	hintEntryHeaderSize = 25
+	// hintTrailerSize is the size of the trailer closing a hint file: the
+	// size of the datafile it describes and a checksum of everything before.
+	hintTrailerSize = 8
+)
+
+// hintEntry locates the last record written for a key in a datafile, so the
+// key directory can be rebuilt without reading the values back. The last
+// record can be a tombstone.
+type hintEntry struct {
+	Key        string
+	Timestamp  uint32
+	Offset     uint32
+	ObjectSize uint32
+	Type       recordType
+	Expiry     uint64
+}
+
+// deletes reports whether the record of the entry leaves its key deleted,
+// either as a tombstone or as a value that has expired.
+func (e *hintEntry) deletes() bool {
+	return e.Type == recordTombstone || isExpired(e.Expiry)
+}
+
+// GetHintFile returns the path of the hint file for the datafile identified
+// by fileId.
+func GetHintFile(filePath string, fileId int) string {
+	return filepath.Join(filePath, fmt.Sprintf("data_%v.hint", fileId))
+}
+
+func encodeHint(entries []hintEntry, datafileSize uint32) []byte {
+	size := hintTrailerSize
+	for i := range entries {
+		size += hintEntryHeaderSize + len(entries[i].Key)
+	}
+
+	b := make([]byte, 0, size)
+	for i := range entries {
+		b = binary.BigEndian.AppendUint32(b, entries[i].Timestamp)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(entries[i].Key)))
+		b = binary.BigEndian.AppendUint32(b, entries[i].ObjectSize)
+		b = binary.BigEndian.AppendUint32(b, entries[i].Offset)
+		b = append(b, byte(entries[i].Type))
+		b = binary.BigEndian.AppendUint64(b, entries[i].Expiry)
+		b = append(b, entries[i].Key...)
+	}
+	b = binary.BigEndian.AppendUint32(b, datafileSize)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// decodeHint decodes a hint file and returns its entries along with the size
+// of the datafile it was written for.
+func decodeHint(b []byte) ([]hintEntry, uint32, error) {
+	if len(b) < hintTrailerSize {
+		return nil, 0, ErrCorruptHint
+	}
+	body, trailer := b[:len(b)-hintTrailerSize], b[len(b)-hintTrailerSize:]
+	if crc32.ChecksumIEEE(b[:len(b)-crcSize]) != binary.BigEndian.Uint32(trailer[4:]) {
+		return nil, 0, ErrCorruptHint
+	}
+
+	var entries []hintEntry
+	for len(body) > 0 {
+		if len(body) < hintEntryHeaderSize {
+			return nil, 0, ErrCorruptHint
+		}
+		keySize := binary.BigEndian.Uint32(body[4:])
+		if uint64(len(body)) < hintEntryHeaderSize+uint64(keySize) {
+			return nil, 0, ErrCorruptHint
+		}
+		entries = append(entries, hintEntry{
+			Timestamp:  binary.BigEndian.Uint32(body),
+			ObjectSize: binary.BigEndian.Uint32(body[8:]),
+			Offset:     binary.BigEndian.Uint32(body[12:]),
+			Type:       recordType(body[16]),
+			Expiry:     binary.BigEndian.Uint64(body[17:]),
+			Key:        string(body[hintEntryHeaderSize : hintEntryHeaderSize+keySize]),
+		})
+		body = body[hintEntryHeaderSize+keySize:]
+	}
+
+	return entries, binary.BigEndian.Uint32(trailer), nil
+}
+
+// writeHintFile writes the hint file at path. It is written to a temporary
+// file first and renamed into place, so a crash never leaves half a hint.
+func writeHintFile(path string, entries []hintEntry, datafileSize uint32) error {
+	tmp := path + tempExt
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(encodeHint(entries, datafileSize)); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// readHintFile reads the hint file of the datafile dt identified by fileId.
+// A hint written for a different version of the datafile is reported as
+// ErrCorruptHint.
+func (s *Store) readHintFile(fileId int, dt *datafile.Datafile) ([]hintEntry, error) {
+	b, err := os.ReadFile(GetHintFile(s.dir(), fileId))
+	if err != nil {
+		return nil, err
+	}
+
+	entries, datafileSize, err := decodeHint(b)
+	if err != nil {
+		return nil, err
+	}
+	if int(datafileSize) != dt.Size() {
+		return nil, fmt.Errorf("%w: written for %d bytes of datafile, found %d", ErrCorruptHint, datafileSize, dt.Size())
+	}
+
+	return entries, nil
+}
+
+// scanHintEntries scans the datafile dt and returns a hint entry for the last
+// record of every key in it, in the order the keys were first written.
+func (s *Store) scanHintEntries(dt *datafile.Datafile) ([]hintEntry, uint32, error) {
+	var entries []hintEntry
+	index := make(map[string]int)
+
+	end, err := s.scanDatafile(dt, func(offset uint32, record *Record) {
+		entry := hintEntry{
+			Key:        record.Key,
+			Timestamp:  record.Timestamp,
+			Offset:     offset,
+			ObjectSize: record.size(),
+			Type:       record.Type,
+			Expiry:     record.Expiry,
+		}
+		if i, ok := index[record.Key]; ok {
+			entries[i] = entry
+			return
+		}
+		index[record.Key] = len(entries)
+		entries = append(entries, entry)
+	})
+
+	return entries, end, err
+}
+
+// buildHintFile writes the hint file for the sealed datafile dt identified by
+// fileId.
+func (s *Store) buildHintFile(fileId int, dt *datafile.Datafile) error {
+	entries, end, err := s.scanHintEntries(dt)
+	if err != nil {
+		return err
+	}
+	if int(end) != dt.Size() {
+		return fmt.Errorf("datafile %d has an invalid tail at offset %d", fileId, end)
+	}
+
+	return writeHintFile(GetHintFile(s.dir(), fileId), entries, end)
+}
+
+// mapDatafile maps the sealed datafile dt identified by fileId into memory
+// when reads go through mappings. One that cannot be mapped is read as
+// before.
+func (s *Store) mapDatafile(fileId int, dt *datafile.Datafile) {
+	if !s.cfg.MmapReads {
+		return
+	}
+	if err := dt.Map(); err != nil {
+		const msg = "failed to map datafile, reading it without"
+		s.Log.Warn(msg, zap.Error(err), zap.Int("fileId", fileId))
+	}
+}
+
+// sealDatafile closes the datafile dt identified by fileId for writing and
+// writes its hint file in the background. A failed sync is returned, the
+// datafile is sealed all the same but what was written to it may not be on
+// disk. The caller must hold the store lock.
+func (s *Store) sealDatafile(fileId int, dt *datafile.Datafile) error {
+	var sealErr error
+	if err := dt.Seal(); err != nil {
+		const msg = "failed to seal datafile"
+		s.Log.Error(msg, zap.Error(err), zap.Int("fileId", fileId))
+		sealErr = fmt.Errorf(msg+": %w", err)
+	}
+	s.mapDatafile(fileId, dt)
+
+	s.hints.add(fileId)
+	go func() {
+		defer s.hints.done(fileId)
+		if err := s.buildHintFile(fileId, dt); err != nil {
+			const msg = "failed to write hint file"
+			s.Log.Error(msg, zap.Error(err), zap.Int("fileId", fileId))
+		}
+	}()
+	return sealErr
+}
+
+// hintWriters tracks the hint files being written in the background. Unlike a
+// sync.WaitGroup it can be waited on while more are started.
+type hintWriters struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	writing map[int]struct{}
+}
+
+func newHintWriters() *hintWriters {
+	h := &hintWriters{writing: make(map[int]struct{})}
+	h.cond = sync.NewCond(&h.mu)
+	return h
+}
+
+func (h *hintWriters) add(fileId int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writing[fileId] = struct{}{}
+}
+
+func (h *hintWriters) done(fileId int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.writing, fileId)
+	h.cond.Broadcast()
+}
+
+// busy reports whether the hint file of the datafile identified by fileId is
+// still being written.
+func (h *hintWriters) busy(fileId int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.writing[fileId]
+	return ok
+}
+
+// wait returns once no hint file is being written.
+func (h *hintWriters) wait() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for len(h.writing) > 0 {
+		h.cond.Wait()
+	}
+}
+
+// waitFor returns once none of the hint files of files is being written.
+func (h *hintWriters) waitFor(files datafile.FileDir) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writing := func() bool {
+		for fileId := range files {
+			if _, ok := h.writing[fileId]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	for writing() {
+		h.cond.Wait()
+	}
+}
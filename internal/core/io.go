@@ -4,14 +4,23 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/ajaxchavan/bytecask/internal/config"
 )
 
+// argsPrealloc caps the number of arguments room is made for up front, a
+// client announcing a large command does not get to allocate for all of it
+// before sending it.
+const argsPrealloc = 1024
+
 type RespParser struct {
 	c   io.ReadWriter
 	buf *bytes.Buffer
 	p   []byte
+	// cmd is how far the command at the start of buf was parsed.
+	cmd multibulk
 }
 
 func NewParser(c io.ReadWriter) (*RespParser, error) {
@@ -28,40 +37,192 @@ func NewParserWithBytes(c io.ReadWriter, bt []byte) (*RespParser, error) {
 	}, nil
 }
 
-func (r *RespParser) readString() (string, error) {
-	line, err := r.buf.ReadString('\r')
-	if err != nil && err != io.EOF {
-		return "", err
-	}
+// Decode reads from the connection until a complete command is buffered and
+// returns its arguments, command name first. Both RESP arrays of bulk strings,
+// as sent by redis-cli and client libraries, and the inline form are accepted.
+// Bulk arguments are binary safe and may hold any byte, including CR, LF and
+// NUL. An empty slice is returned for a blank inline line.
+func (r *RespParser) Decode() ([][]byte, error) {
+	for {
+		args, n, err := r.cmd.parse(r.buf.Bytes())
+		if err == nil {
+			r.buf.Next(n)
+			return args, nil
+		}
+		if err != ErrIncomplete {
+			return nil, err
+		}
 
-	// skip '\r'
-	return line[:len(line)-1], nil
+		n, err = r.c.Read(r.p)
+		if n > 0 {
+			r.buf.Write(r.p[:n])
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
 }
 
-func (r *RespParser) Decode() (string, error) {
+// DecodeCmds performs a single read from the connection and then decodes every
+// complete command buffered so far, in the order they were sent. Bytes of a
+// trailing partial command stay buffered until the next call. The commands
+// are returned even when the read itself fails, so a client that pipelines a
+// batch and closes its end still gets it executed.
+func (r *RespParser) DecodeCmds() ([]*Cmd, error) {
+	n, err := r.c.Read(r.p)
+	if n > 0 {
+		r.buf.Write(r.p[:n])
+	} else if err == nil {
+		err = io.EOF
+	}
+
+	var cmds []*Cmd
 	for {
-		n, err := r.c.Read(r.p)
-		if n <= 0 {
+		args, n, perr := r.cmd.parse(r.buf.Bytes())
+		if perr != nil {
+			if perr != ErrIncomplete {
+				return cmds, perr
+			}
 			break
 		}
+		r.buf.Next(n)
+		if cmd := NewCmd(args); cmd != nil {
+			cmds = append(cmds, cmd)
+		}
+	}
 
-		r.buf.Write(r.p[:n])
+	return cmds, err
+}
+
+// multibulk is how far parsing a command sent as a RESP array got. It is kept
+// between reads, so a command arriving in many of them is not parsed from its
+// start again on every one.
+type multibulk struct {
+	// count is the number of arguments, zero until the header is parsed.
+	count int
+	// pos is where parsing goes on, spans holds where each argument parsed
+	// so far starts and ends.
+	pos   int
+	spans [][2]int
+}
+
+// parse parses one command from the start of b and returns its arguments
+// along with the number of bytes consumed. ErrIncomplete is returned when b
+// does not yet hold the whole command, b must then start with the same bytes
+// on the next call. The arguments are only copied out of b once the command
+// is complete.
+func (m *multibulk) parse(b []byte) ([][]byte, int, error) {
+	args, n, err := m.parseArgs(b)
+	if err != ErrIncomplete {
+		*m = multibulk{}
+	}
+	return args, n, err
+}
+
+func (m *multibulk) parseArgs(b []byte) ([][]byte, int, error) {
+	if m.count == 0 {
+		if len(b) == 0 {
+			return nil, 0, ErrIncomplete
+		}
+		if b[0] != '*' {
+			return parseInline(b)
+		}
+
+		line, pos, err := readLine(b)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return "", err
+			return nil, 0, err
+		}
+		count, err := strconv.Atoi(string(line[1:]))
+		if err != nil || count > config.MultiBulkLengthMax {
+			return nil, 0, protocolError("invalid multibulk length")
+		}
+		if count <= 0 {
+			return [][]byte{}, pos, nil
 		}
+		m.count, m.pos = count, pos
+		m.spans = make([][2]int, 0, min(count, argsPrealloc))
+	}
 
-		if bytes.Contains(r.p, []byte{'\r', '\n'}) {
-			break
+	for len(m.spans) < m.count {
+		line, n, err := readLine(b[m.pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		if line[0] != '$' {
+			return nil, 0, protocolError(fmt.Sprintf("expected '$', got '%c'", line[0]))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > config.BulkLengthMax {
+			return nil, 0, protocolError("invalid bulk length")
 		}
 
-		if r.buf.Len() >= config.IOBufferLengthMax {
-			return "", fmt.Errorf("input too long. max input can be %d bytes", config.IOBufferLengthMax)
+		start := m.pos + n
+		if len(b) < start+size+2 {
+			return nil, 0, ErrIncomplete
+		}
+		if b[start+size] != '\r' || b[start+size+1] != '\n' {
+			return nil, 0, protocolError("bulk string is not terminated by CRLF")
 		}
+		m.spans = append(m.spans, [2]int{start, start + size})
+		m.pos = start + size + 2
 	}
-	//TODO: implement https://bou.ke/blog/hacking-developers
 
-	return r.readString()
+	// copy out of the read buffer, which is reused for later input, into a
+	// single allocation
+	total := 0
+	for _, span := range m.spans {
+		total += span[1] - span[0]
+	}
+	data := make([]byte, 0, total)
+	args := make([][]byte, len(m.spans))
+	for i, span := range m.spans {
+		from := len(data)
+		data = append(data, b[span[0]:span[1]]...)
+		args[i] = data[from:len(data):len(data)]
+	}
+	return args, m.pos, nil
+}
+
+// parseInline parses a command sent as a single space separated line, the
+// way it is typed into telnet or netcat.
+func parseInline(b []byte) ([][]byte, int, error) {
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		if len(b) > config.IOBufferLengthMax {
+			return nil, 0, protocolError("too big inline request")
+		}
+		return nil, 0, ErrIncomplete
+	}
+
+	line := string(bytes.TrimRight(b[:i], "\r"))
+	args := make([][]byte, 0)
+	line = strings.TrimSpace(line)
+	for len(line) > 0 {
+		j, arg := evalCmd(line)
+		if j == 0 {
+			return nil, 0, protocolError("unbalanced quotes in request")
+		}
+		args = append(args, []byte(arg))
+		line = strings.TrimSpace(line[j:])
+	}
+
+	return args, i + 1, nil
+}
+
+// readLine returns the CRLF terminated line at the start of b without the
+// terminator, and the number of bytes it takes up including the terminator.
+func readLine(b []byte) ([]byte, int, error) {
+	i := bytes.Index(b, []byte{'\r', '\n'})
+	if i < 0 {
+		if len(b) > config.IOBufferLengthMax {
+			return nil, 0, protocolError("too big request header")
+		}
+		return nil, 0, ErrIncomplete
+	}
+	if i < 1 {
+		return nil, 0, protocolError("empty line")
+	}
+	return b[:i], i + 2, nil
 }
@@ -0,0 +1,199 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+)
+
+type conn struct {
+	*bytes.Buffer
+}
+
+func newConn(data string) *conn {
+	return &conn{Buffer: bytes.NewBufferString(data)}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  [][]byte
+	}{
+		{"resp array", "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n", [][]byte{[]byte("SET"), []byte("foo"), []byte("bar")}},
+		{"empty bulk", "*2\r\n$3\r\nGET\r\n$0\r\n\r\n", [][]byte{[]byte("GET"), {}}},
+		{"binary bulk", "*2\r\n$4\r\nPING\r\n$4\r\n\x00\r\n\xff\r\n", [][]byte{[]byte("PING"), []byte("\x00\r\n\xff")}},
+		{"inline", "set foo bar\r\n", [][]byte{[]byte("set"), []byte("foo"), []byte("bar")}},
+		{"inline quoted", "set foo 'hello world'\r\n", [][]byte{[]byte("set"), []byte("foo"), []byte("hello world")}},
+		{"inline newline only", "ping\n", [][]byte{[]byte("ping")}},
+		{"blank inline", "\r\n", [][]byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp, _ := NewParser(newConn(tt.input))
+			got, err := rp.Decode()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDecodeLargeBulk(t *testing.T) {
+	value := bytes.Repeat([]byte{'\r', '\n', 0}, 100*1024)
+	input := fmt.Sprintf("*2\r\n$4\r\nPING\r\n$%d\r\n%s\r\n", len(value), value)
+
+	rp, _ := NewParser(newConn(input))
+	args, err := rp.Decode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(args) != 2 || !bytes.Equal(args[1], value) {
+		t.Errorf("large bulk argument was not decoded intact")
+	}
+}
+
+func TestDecodeCmdsPipelined(t *testing.T) {
+	c := newConn("*2\r\n$3\r\nGET\r\n$1\r\na\r\nPING\r\n\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n*2\r\n$3\r\nGET")
+	rp, _ := NewParser(c)
+
+	cmds, err := rp.DecodeCmds()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, cmd := range cmds {
+		got = append(got, cmd.Cmd)
+	}
+	if want := []string{"GET", "PING", "GET"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	// the partial command is kept until the rest of it arrives
+	c.WriteString("\r\n$1\r\nc\r\n")
+	cmds, err = rp.DecodeCmds()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cmds) != 1 || string(cmds[0].Args[0]) != "c" {
+		t.Fatalf("expected the buffered command to complete, got %v", cmds)
+	}
+
+	if _, err := rp.DecodeCmds(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected %v, got %v", io.EOF, err)
+	}
+}
+
+func TestDecodeCmdsInPieces(t *testing.T) {
+	allocated := func(fn func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		fn()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+
+	// a command of many arguments arriving a read at a time is not parsed
+	// from its start again on every read
+	const keys = 50_000
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "*%d\r\n$3\r\nDEL\r\n", keys+1)
+	for i := 0; i < keys; i++ {
+		fmt.Fprintf(&input, "$6\r\nk%05d\r\n", i)
+	}
+	size := input.Len()
+
+	c := newConn("")
+	rp, _ := NewParser(c)
+	var cmds []*Cmd
+	alloc := allocated(func() {
+		for input.Len() > 0 {
+			c.Write(input.Next(config.IOBufferLength))
+			got, err := rp.DecodeCmds()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			cmds = append(cmds, got...)
+		}
+	})
+	if len(cmds) != 1 || len(cmds[0].Args) != keys || string(cmds[0].Args[keys-1]) != fmt.Sprintf("k%05d", keys-1) {
+		t.Fatalf("command arriving in pieces was not decoded intact")
+	}
+	// parsing from the start on every read allocated some 90 times the size,
+	// the bound leaves room for the race detector
+	if alloc > 32*uint64(size) {
+		t.Fatalf("decoding a %d byte command allocated %d bytes", size, alloc)
+	}
+
+	// announcing a large command costs little until it is sent
+	c.WriteString("*1048576\r\n")
+	alloc = allocated(func() {
+		if _, err := rp.DecodeCmds(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	if alloc > 64*1024 {
+		t.Fatalf("announcing a large command allocated %d bytes", alloc)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{"bad multibulk length", "*x\r\n", ErrProtocol},
+		{"multibulk length too large", "*1048577\r\n", ErrProtocol},
+		{"negative multibulk length", "*-5\r\n*1\r\n$4\r\nPING\r\n", nil},
+		{"bulk length too large", "*1\r\n$536870913\r\n", ErrProtocol},
+		{"missing bulk prefix", "*1\r\n:1\r\n", ErrProtocol},
+		{"bulk without crlf", "*1\r\n$3\r\nfoobar\r\n", ErrProtocol},
+		{"unbalanced quotes", "set foo 'bar\r\n", ErrProtocol},
+		{"truncated", "*2\r\n$3\r\nGET\r\n$3\r\nfo", io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp, _ := NewParser(newConn(tt.input))
+			if _, err := rp.Decode(); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		isSimple bool
+		want     string
+	}{
+		{"simple string", "OK", true, "+OK\r\n"},
+		{"bulk string", "foo", false, "$3\r\nfoo\r\n"},
+		{"bytes", []byte("a\r\nb"), false, "$4\r\na\r\nb\r\n"},
+		{"null bulk", nil, false, "$-1\r\n"},
+		{"integer", 42, false, ":42\r\n"},
+		{"error", errors.New("ERR boom"), false, "-ERR boom\r\n"},
+		{"array", []string{"a", "bc"}, false, "*2\r\n$1\r\na\r\n$2\r\nbc\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(Encode(tt.value, tt.isSimple)); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -1,10 +1,194 @@
 package core
 
-type KeyDir map[string]*Meta
+import (
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/ajaxchavan/bytecask/internal/btree"
+)
+
+// KeyDir maps every key to the location of its newest record and keeps the
+// keys in order. Only shardedKeyDir is safe for concurrent use, the store
+// keeps the others inside its shards.
+type KeyDir interface {
+	// Get returns the entry of key and whether there is one.
+	Get(key string) (Meta, bool)
+	// Put sets the entry of key.
+	Put(key string, meta Meta)
+	// Delete removes the entry of key, if any.
+	Delete(key string)
+	// Len returns the number of keys.
+	Len() int
+	// Ascend calls fn for every key from from on, in order, until fn returns
+	// false. The key directory must not be changed until Ascend returns.
+	Ascend(from string, fn func(key string, meta Meta) bool)
+	// Clone returns a copy the original can be changed apart from.
+	Clone() KeyDir
+	// SampleExpiring returns up to n keys that have an expiry, picked at
+	// random. All of them are returned when there are no more than n.
+	SampleExpiring(n int) []string
+}
+
+// newKeyDir returns a packed key directory when compact is set and a map
+// otherwise.
+func newKeyDir(compact bool) KeyDir {
+	if compact {
+		return newPackedKeyDir()
+	}
+	return newMapKeyDir()
+}
+
+// mapKeyDir is a map from keys to their entries, next to a B-tree holding the
+// keys in order. It is fast, but every key costs two strings and the map
+// entry, all of which the garbage collector scans.
+type mapKeyDir struct {
+	metas map[string]Meta
+	index *btree.BTree[string]
+	// expiring holds the keys that have an expiry.
+	expiring map[string]struct{}
+}
+
+func newMapKeyDir() *mapKeyDir {
+	return &mapKeyDir{metas: make(map[string]Meta), index: btree.New(), expiring: make(map[string]struct{})}
+}
+
+func (d *mapKeyDir) Get(key string) (Meta, bool) {
+	meta, ok := d.metas[key]
+	return meta, ok
+}
+
+func (d *mapKeyDir) Put(key string, meta Meta) {
+	if _, ok := d.metas[key]; !ok {
+		d.index.Insert(key)
+	}
+	d.metas[key] = meta
+	if meta.Expiry != 0 {
+		d.expiring[key] = struct{}{}
+	} else {
+		delete(d.expiring, key)
+	}
+}
+
+func (d *mapKeyDir) Delete(key string) {
+	if _, ok := d.metas[key]; ok {
+		delete(d.metas, key)
+		delete(d.expiring, key)
+		d.index.Delete(key)
+	}
+}
+
+func (d *mapKeyDir) Len() int {
+	return len(d.metas)
+}
+
+func (d *mapKeyDir) Ascend(from string, fn func(key string, meta Meta) bool) {
+	d.index.Ascend(from, func(key string) bool {
+		return fn(key, d.metas[key])
+	})
+}
+
+func (d *mapKeyDir) Clone() KeyDir {
+	return &mapKeyDir{metas: maps.Clone(d.metas), index: d.index.Clone(strings.Compare), expiring: maps.Clone(d.expiring)}
+}
+
+// SampleExpiring takes the keys the map happens to list first, it starts at
+// a random one every time.
+func (d *mapKeyDir) SampleExpiring(n int) []string {
+	keys := make([]string, 0, min(n, len(d.expiring)))
+	for key := range d.expiring {
+		if len(keys) == n {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
 
 type Meta struct {
 	Timestamp  uint32
 	Offset     uint32
 	ObjectSize uint32
 	FileId     int
+	// Expiry is the unix time in milliseconds the key expires at, zero when
+	// it does not expire.
+	Expiry uint64
+	// Version changes every time the key is written, WATCH and merges
+	// compare it to tell whether a key changed.
+	Version uint64
+}
+
+// now returns the current time in the unit of expiry timestamps.
+func now() uint64 {
+	return uint64(time.Now().UnixMilli())
+}
+
+// isExpired reports whether a value with the given expiry has expired.
+func isExpired(expiry uint64) bool {
+	return expiry != 0 && expiry <= now()
+}
+
+// lookup returns the key directory entry of key and whether the key exists.
+// An expired key is removed on the way. The caller must hold the store lock,
+// readers use peek.
+func (s *Store) lookup(key string) (Meta, bool) {
+	meta, ok := s.KeyDir.Get(key)
+	if !ok {
+		return Meta{}, false
+	}
+	if isExpired(meta.Expiry) {
+		s.expireMeta(key)
+		return Meta{}, false
+	}
+	return meta, true
+}
+
+// peek is lookup for readers, which do not hold the store lock. An expired
+// key reads as missing but is left for the sweeper or the next write.
+func (s *Store) peek(key string) (Meta, bool) {
+	meta, ok := s.KeyDir.Get(key)
+	if !ok || isExpired(meta.Expiry) {
+		return Meta{}, false
+	}
+	return meta, true
+}
+
+// putMeta points key at meta and moves the bytes of the record it replaces
+// from live to dead. A meta without a version is given a new one. The caller
+// must hold the store lock.
+func (s *Store) putMeta(key string, meta Meta) {
+	if meta.Version == 0 {
+		s.version++
+		meta.Version = s.version
+	}
+	if old, ok := s.KeyDir.Get(key); ok {
+		s.live[old.FileId] -= int64(old.ObjectSize)
+	}
+	s.KeyDir.Put(key, meta)
+	s.live[meta.FileId] += int64(meta.ObjectSize)
+}
+
+// deleteMeta removes key, its record no longer counts as live. The caller
+// must hold the store lock.
+func (s *Store) deleteMeta(key string) {
+	if old, ok := s.KeyDir.Get(key); ok {
+		s.live[old.FileId] -= int64(old.ObjectSize)
+		s.KeyDir.Delete(key)
+	}
+}
+
+// expireMeta removes the expired key. Its record now hides older values of
+// the key like a tombstone does and is accounted as one. The caller must hold
+// the store lock.
+func (s *Store) expireMeta(key string) {
+	meta, _ := s.KeyDir.Get(key)
+	s.deleteMeta(key)
+	s.tombstones[meta.FileId] += int64(meta.ObjectSize)
+}
+
+// deadBytes returns the number of bytes in the datafile identified by fileId
+// that neither the key directory points at nor belong to a tombstone. The
+// caller must hold the store lock.
+func (s *Store) deadBytes(fileId int) int64 {
+	return int64(s.FileDir[fileId].Size()) - s.live[fileId] - s.tombstones[fileId]
 }
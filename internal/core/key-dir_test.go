@@ -0,0 +1,175 @@
+package core
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var keyDirKeys = flag.Int("keydir.keys", 1_000_000, "number of keys BenchmarkKeyDirMemory fills the key directory with")
+
+func ascendKeys(d KeyDir, from string) []string {
+	var keys []string
+	d.Ascend(from, func(key string, _ Meta) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func TestKeyDir(t *testing.T) {
+	for _, tc := range []struct {
+		shards  int
+		compact bool
+	}{{0, false}, {0, true}, {8, false}, {8, true}} {
+		t.Run(fmt.Sprintf("shards=%d/compact=%v", tc.shards, tc.compact), func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			d := newKeyDir(tc.compact)
+			if tc.shards > 0 {
+				d = newShardedKeyDir(tc.shards, tc.compact)
+			}
+			want := make(map[string]Meta)
+
+			var clone KeyDir
+			var cloned map[string]Meta
+			for i := 0; i < 100_000; i++ {
+				key := fmt.Sprintf("key%06d", r.Intn(20_000))
+				switch r.Intn(3) {
+				case 0:
+					d.Delete(key)
+					delete(want, key)
+				default:
+					meta := Meta{FileId: r.Intn(100), Offset: r.Uint32(), ObjectSize: r.Uint32(), Version: uint64(i + 1)}
+					if r.Intn(2) == 0 {
+						meta.Expiry = uint64(i + 1)
+					}
+					d.Put(key, meta)
+					want[key] = meta
+				}
+				if i == 50_000 {
+					clone = d.Clone()
+					cloned = make(map[string]Meta, len(want))
+					for key, meta := range want {
+						cloned[key] = meta
+					}
+				}
+			}
+			// keys that all go again leave enough holes for the packed slabs
+			// to be compacted
+			for i := 0; i < 60_000; i++ {
+				d.Put(fmt.Sprintf("churn%059d", i), Meta{Version: 1})
+			}
+			for i := 0; i < 60_000; i++ {
+				d.Delete(fmt.Sprintf("churn%059d", i))
+			}
+
+			for _, c := range []struct {
+				d    KeyDir
+				want map[string]Meta
+			}{{d, want}, {clone, cloned}} {
+				if c.d.Len() != len(c.want) {
+					t.Fatalf("got %d keys, want %d", c.d.Len(), len(c.want))
+				}
+				sorted := make([]string, 0, len(c.want))
+				for key, meta := range c.want {
+					sorted = append(sorted, key)
+					if got, ok := c.d.Get(key); !ok || got != meta {
+						t.Fatalf("get %s: got %+v, %v, want %+v", key, got, ok, meta)
+					}
+				}
+				sort.Strings(sorted)
+
+				var expiring []string
+				for _, key := range sorted {
+					if c.want[key].Expiry != 0 {
+						expiring = append(expiring, key)
+					}
+				}
+				got := c.d.SampleExpiring(len(c.want))
+				sort.Strings(got)
+				if fmt.Sprint(got) != fmt.Sprint(expiring) {
+					t.Fatalf("got %d expiring keys, want %d", len(got), len(expiring))
+				}
+				for _, key := range c.d.SampleExpiring(10) {
+					if c.want[key].Expiry == 0 {
+						t.Fatalf("sampled %s, which has no expiry", key)
+					}
+				}
+
+				for _, from := range []string{"", "key025000", "key0250005", "key999999"} {
+					i := sort.SearchStrings(sorted, from)
+					if got := ascendKeys(c.d, from); fmt.Sprint(got) != fmt.Sprint(sorted[i:]) {
+						t.Fatalf("ascend from %q: got %d keys, want %d", from, len(got), len(sorted)-i)
+					}
+				}
+			}
+			if _, ok := d.Get("missing"); ok {
+				t.Fatal("got a key that was never put")
+			}
+		})
+	}
+}
+
+// BenchmarkKeyDirMemory fills a key directory, one key in ten with an
+// expiry, and reports the heap it takes per key and how long a full garbage
+// collection takes with it live. Run it at scale with
+//
+//	go test ./internal/core -run '^$' -bench KeyDirMemory -benchtime 1x -keydir.keys 50000000
+func BenchmarkKeyDirMemory(b *testing.B) {
+	for _, compact := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compact=%v", compact), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				d := newKeyDir(compact)
+				buf := []byte("key:")
+				for n := 0; n < *keyDirKeys; n++ {
+					key := string(strconv.AppendInt(buf[:4], int64(n), 10))
+					meta := Meta{FileId: n >> 20, Offset: uint32(n), ObjectSize: 64, Version: uint64(n + 1)}
+					if n%10 == 0 {
+						meta.Expiry = uint64(n + 1)
+					}
+					d.Put(key, meta)
+				}
+
+				start := time.Now()
+				runtime.GC()
+				elapsed := time.Since(start)
+				runtime.ReadMemStats(&after)
+				var stats debug.GCStats
+				debug.ReadGCStats(&stats)
+
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(d.Len()), "B/key")
+				b.ReportMetric(float64(elapsed.Milliseconds()), "gc-ms")
+				b.ReportMetric(float64(stats.Pause[0].Microseconds()), "pause-µs")
+				runtime.KeepAlive(d)
+			}
+		})
+	}
+}
+
+func BenchmarkKeyDirGet(b *testing.B) {
+	const keys = 1 << 20
+	for _, compact := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compact=%v", compact), func(b *testing.B) {
+			d := newKeyDir(compact)
+			for n := 0; n < keys; n++ {
+				d.Put("key:"+strconv.Itoa(n), Meta{Offset: uint32(n)})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := d.Get("key:" + strconv.Itoa(i&(keys-1))); !ok {
+					b.Fatal("missing key")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,5 @@
+package core
+
+// lockFile is the name of the file in the data directory a writer holds an
+// exclusive flock on for as long as the store is open.
+const lockFile = "LOCK"
@@ -0,0 +1,46 @@
+//go:build !unix
+
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Without flock a data directory is only locked against the other stores of
+// the same process.
+var (
+	lockedMu sync.Mutex
+	locked   = make(map[string]struct{})
+)
+
+// lockDirectory takes the lock on the data directory dir, see lockedMu.
+func lockDirectory(dir string) (*os.File, error) {
+	path, err := filepath.Abs(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+	if _, ok := locked[path]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	locked[path] = struct{}{}
+
+	return f, nil
+}
+
+// unlockDirectory releases the lock taken by lockDirectory.
+func unlockDirectory(f *os.File) error {
+	lockedMu.Lock()
+	delete(locked, f.Name())
+	lockedMu.Unlock()
+	return f.Close()
+}
@@ -0,0 +1,329 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/ajaxchavan/bytecask/internal/datafile"
+)
+
+// tempExt is the extension of files that are still being written. They are
+// renamed into place once complete and removed when found at startup.
+const tempExt = ".tmp"
+
+// mergeOutput is a datafile written by a merge.
+type mergeOutput struct {
+	fileId  int
+	dt      *datafile.Datafile
+	entries []hintEntry
+	// sources holds the key directory entry each copied value was live
+	// under, the copy only replaces it if the key was not written since.
+	// It is nil for tombstones.
+	sources []Meta
+}
+
+// mergeInputs returns the ids of the sealed datafiles worth merging, oldest
+// first, along with the id of the oldest datafile left out. Datafiles whose
+// hint file is still being written are left for a later merge. Merged
+// datafiles kept for snapshots, and inputs a snapshot will keep once merged,
+// count as left out: they stay on disk until released, and a crash before
+// that replays them. The caller must hold the store lock.
+func (s *Store) mergeInputs() ([]int, int) {
+	oldest := s.FileId
+	for fileId := range s.FileDir {
+		oldest = min(oldest, fileId)
+	}
+
+	var ids []int
+	oldestKept := s.FileId
+	for fileId := range s.retired {
+		oldestKept = min(oldestKept, fileId)
+	}
+	for fileId := range s.FileDir {
+		if s.hints.busy(fileId) || fileId >= s.FileId || !s.shouldMerge(fileId, fileId == oldest) {
+			oldestKept = min(oldestKept, fileId)
+			continue
+		}
+		if s.refs[fileId] > 0 {
+			oldestKept = min(oldestKept, fileId)
+		}
+		ids = append(ids, fileId)
+	}
+	sort.Ints(ids)
+	return ids, oldestKept
+}
+
+// shouldMerge reports whether enough of the datafile identified by fileId is
+// dead to be worth rewriting. The tombstones of the oldest datafile count as
+// dead, there is nothing left for them to hide. The caller must hold the
+// store lock.
+func (s *Store) shouldMerge(fileId int, oldest bool) bool {
+	dead := s.deadBytes(fileId)
+	if oldest {
+		dead += s.tombstones[fileId]
+	}
+	if dead <= 0 {
+		// an empty datafile is merged away, it would otherwise stay the
+		// oldest and keep the tombstones after it forever
+		return s.FileDir[fileId].Size() == 0
+	}
+	if s.cfg.MergeMinDeadBytes > 0 && dead >= s.cfg.MergeMinDeadBytes {
+		return true
+	}
+	return float64(dead) >= s.cfg.MergeDeadRatio*float64(s.FileDir[fileId].Size())
+}
+
+// compact merges the sealed datafiles with enough dead bytes into new ones
+// holding only the records the key directory still points at. Reads and
+// writes go on while records are copied, the store is only locked to rotate
+// the active datafile at the start and to swap the merged datafiles in at the
+// end.
+//
+// The merged datafiles take ids between the active datafile at the start of
+// the merge and the one writes move on to, so replaying the datafiles in id
+// order still ends on the newest record of every key. Until the swap the
+// inputs are left untouched, so a merge that fails or is interrupted by a
+// crash loses nothing.
+func (s *Store) compact(ctx context.Context) {
+	for s.merge(ctx) {
+		s.Log.Info("datafiles were snapshotted during the merge, merging again")
+	}
+}
+
+// merge runs one merge for compact. It reports whether the merge was thrown
+// away because a snapshot taken meanwhile holds one of its inputs: the
+// tombstones dropped may be all that hides the values of that input once it
+// is kept on disk.
+func (s *Store) merge(ctx context.Context) bool {
+	s.Lock()
+	ids, oldestKept := s.mergeInputs()
+	if len(ids) == 0 {
+		s.Unlock()
+		return false
+	}
+	inputs := make(datafile.FileDir, len(ids))
+	for _, fileId := range ids {
+		inputs[fileId] = s.FileDir[fileId]
+	}
+	// a merge never writes more datafiles than it reads, reserve one id for each
+	firstId := s.FileId + 1
+	lastId := s.FileId + len(ids)
+	if err := s.updateActiveDatafile(lastId + 1); err != nil {
+		s.Unlock()
+		return false
+	}
+	s.Unlock()
+
+	s.Log.Info("merging datafiles", zap.Ints("fileIds", ids))
+
+	outputs, dropped, err := s.mergeDatafiles(ctx, ids, inputs, oldestKept, firstId, lastId)
+	if err == nil {
+		err = s.finishOutputs(outputs)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			const msg = "failed to merge datafiles"
+			s.Log.Error(msg, zap.Error(err))
+		}
+		s.removeOutputs(outputs)
+		return false
+	}
+
+	s.Lock()
+	for _, fileId := range ids {
+		// an input held at the start counts as left out already
+		if fileId < oldestKept && s.refs[fileId] > 0 {
+			s.Unlock()
+			s.removeOutputs(outputs)
+			return ctx.Err() == nil
+		}
+	}
+	for _, out := range outputs {
+		s.FileDir[out.fileId] = out.dt
+	}
+	s.publishFiles()
+	for _, out := range outputs {
+		for i, entry := range out.entries {
+			meta, ok := s.KeyDir.Get(entry.Key)
+			switch {
+			case ok && meta == out.sources[i]:
+				s.putMeta(entry.Key, Meta{
+					Timestamp:  entry.Timestamp,
+					Offset:     entry.Offset,
+					ObjectSize: entry.ObjectSize,
+					FileId:     out.fileId,
+					Expiry:     entry.Expiry,
+					Version:    meta.Version,
+				})
+			case !ok && entry.deletes():
+				s.tombstones[out.fileId] += int64(entry.ObjectSize)
+			}
+		}
+	}
+	for key, meta := range dropped {
+		if current, ok := s.KeyDir.Get(key); ok && current == meta {
+			s.deleteMeta(key)
+		}
+	}
+	var unused []int
+	for _, fileId := range ids {
+		delete(s.FileDir, fileId)
+		delete(s.live, fileId)
+		delete(s.tombstones, fileId)
+		if !s.retire(fileId, inputs[fileId]) {
+			unused = append(unused, fileId)
+		}
+	}
+	s.publishFiles()
+	s.Unlock()
+
+	// readers that looked a key up before the swap retry once their datafile
+	// is closed, see get
+	for _, fileId := range unused {
+		s.removeDatafile(fileId, inputs[fileId])
+	}
+
+	s.Log.Info("merged datafiles", zap.Ints("fileIds", ids), zap.Int("outputs", len(outputs)))
+	return false
+}
+
+// mergeDatafiles copies the live records of the input datafiles into new
+// datafiles numbered from firstId to lastId and returns them. A tombstone, or
+// an expired value, is copied while its key is still deleted and a datafile
+// older than it, from oldestKept on, is left out of the merge. The value it
+// hides could otherwise come back on the next start. Expired values that are
+// dropped are returned along with the key directory entry they were live
+// under.
+func (s *Store) mergeDatafiles(ctx context.Context, ids []int, inputs datafile.FileDir, oldestKept, firstId, lastId int) ([]*mergeOutput, map[string]Meta, error) {
+	var (
+		outputs []*mergeOutput
+		out     *mergeOutput
+		dropped = make(map[string]Meta)
+	)
+
+	for _, fileId := range ids {
+		dt := inputs[fileId]
+		entries, err := s.readHintFile(fileId, dt)
+		if err != nil {
+			if entries, _, err = s.scanHintEntries(dt); err != nil {
+				return outputs, nil, fmt.Errorf("datafile %d: %w", fileId, err)
+			}
+		}
+
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return outputs, nil, err
+			}
+
+			meta, ok := s.KeyDir.Get(entry.Key)
+			if ok && (meta.FileId != fileId || meta.Offset != entry.Offset) {
+				// the key was written again, the record is dead
+				continue
+			}
+			if entry.deletes() {
+				if fileId < oldestKept {
+					if ok {
+						dropped[entry.Key] = meta
+					}
+					continue
+				}
+			} else if !ok {
+				continue
+			}
+
+			// never carry a corrupt record over into a merged datafile
+			object, err := dt.Read(entry.Offset, entry.ObjectSize)
+			if err != nil {
+				return outputs, nil, fmt.Errorf("datafile %d: %w", fileId, err)
+			}
+			record, err := decodeRecord(object)
+			if err == nil && record.Key != entry.Key {
+				err = ErrCorruptRecord
+			}
+			if err != nil {
+				return outputs, nil, fmt.Errorf("datafile %d at offset %d: %w", fileId, entry.Offset, err)
+			}
+
+			if out == nil || (out.dt.IsFull(s.cfg.MaxDatafileSize, len(object)) && out.fileId < lastId) {
+				nextId := firstId
+				if out != nil {
+					nextId = out.fileId + 1
+				}
+				df, err := datafile.New(datafile.GetDatafile(s.dir(), nextId) + tempExt)
+				if err != nil {
+					return outputs, nil, err
+				}
+				out = &mergeOutput{fileId: nextId, dt: df}
+				outputs = append(outputs, out)
+			}
+
+			offset, err := out.dt.Append(object)
+			if err != nil {
+				return outputs, nil, err
+			}
+			out.entries = append(out.entries, hintEntry{
+				Key:        entry.Key,
+				Timestamp:  entry.Timestamp,
+				Offset:     uint32(offset),
+				ObjectSize: entry.ObjectSize,
+				Type:       entry.Type,
+				Expiry:     entry.Expiry,
+			})
+			out.sources = append(out.sources, meta)
+		}
+	}
+
+	return outputs, dropped, nil
+}
+
+// finishOutputs syncs the merged datafiles, writes their hint files and
+// renames them into place.
+func (s *Store) finishOutputs(outputs []*mergeOutput) error {
+	for _, out := range outputs {
+		if err := out.dt.Seal(); err != nil {
+			return err
+		}
+		s.mapDatafile(out.fileId, out.dt)
+		path := datafile.GetDatafile(s.dir(), out.fileId)
+		if err := writeHintFile(GetHintFile(s.dir(), out.fileId), out.entries, uint32(out.dt.Size())); err != nil {
+			return err
+		}
+		if err := os.Rename(path+tempExt, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOutputs closes and removes the datafiles of a merge that failed.
+func (s *Store) removeOutputs(outputs []*mergeOutput) {
+	for _, out := range outputs {
+		_ = out.dt.Close()
+		path := datafile.GetDatafile(s.dir(), out.fileId)
+		for _, p := range []string{path + tempExt, path, GetHintFile(s.dir(), out.fileId)} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				const msg = "failed to remove the output of a failed merge"
+				s.Log.Error(msg, zap.Error(err), zap.String("path", p))
+			}
+		}
+	}
+}
+
+// removeTempFiles removes the files left behind by writes a crash cut short.
+func removeTempFiles(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+tempExt))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+)
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir, config.WithMaxDatafileSize(512))
+
+	want := make(map[string][]byte)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key%d", i)
+			value := []byte(fmt.Sprintf("value%d-%d", i, round))
+			if err := store.set(key, value); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = value
+		}
+	}
+	for i := 0; i < 40; i += 4 {
+		key := fmt.Sprintf("key%d", i)
+		if _, err := store.del(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, key)
+	}
+	store.hints.wait()
+
+	before, _ := filepath.Glob(filepath.Join(store.dir(), "*.db"))
+
+	// keep writing while the merge runs, including keys it is moving
+	var wg sync.WaitGroup
+	written := make(map[string][]byte)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key%d", (i*7)%40)
+			value := []byte(fmt.Sprintf("concurrent%d", i))
+			if err := store.set(key, value); err != nil {
+				t.Error(err)
+				return
+			}
+			written[key] = value
+		}
+	}()
+	store.compact(context.Background())
+	wg.Wait()
+	for key, value := range written {
+		want[key] = value
+	}
+
+	after, _ := filepath.Glob(filepath.Join(store.dir(), "*.db"))
+	if len(after) >= len(before) {
+		t.Fatalf("merge left %d datafiles, had %d", len(after), len(before))
+	}
+
+	check := func(store *Store) {
+		t.Helper()
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("key%d", i)
+			got, err := store.get(key)
+			value, ok := want[key]
+			if !ok {
+				if err != ErrKeyNotFound {
+					t.Fatalf("get %s: got %q, %v, want ErrKeyNotFound", key, got, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("get %s: %v", key, err)
+			}
+			if !bytes.Equal(got, value) {
+				t.Fatalf("get %s: got %q, want %q", key, got, value)
+			}
+		}
+	}
+	check(store)
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store = newTestStore(t, dir, config.WithMaxDatafileSize(512))
+	defer store.Close()
+	check(store)
+}
+
+func TestCompactCancelled(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir, config.WithMaxDatafileSize(128))
+	defer store.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := store.set(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.hints.wait()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store.compact(ctx)
+
+	if tmp, _ := filepath.Glob(filepath.Join(store.dir(), "*"+tempExt)); len(tmp) != 0 {
+		t.Fatalf("cancelled merge left %v behind", tmp)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := store.get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatalf("get key%d: %v", i, err)
+		}
+	}
+}
+
+func TestMergePolicy(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir, config.WithMaxDatafileSize(256))
+	defer store.Close()
+
+	set := func(prefix string, round int) {
+		for i := 0; i < 10; i++ {
+			if err := store.set(fmt.Sprintf("%s%d", prefix, i), []byte(fmt.Sprintf("value-%d", round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the datafiles holding the first round of stale keys end up all dead,
+	// the ones holding healthy keys are never overwritten
+	set("stale", 0)
+	set("healthy", 0)
+	set("stale", 1)
+	store.hints.wait()
+
+	store.Lock()
+	var stale, healthy []int
+	for fileId := range store.FileDir {
+		if fileId == store.FileId {
+			continue
+		}
+		if store.shouldMerge(fileId, false) {
+			stale = append(stale, fileId)
+		} else {
+			healthy = append(healthy, fileId)
+		}
+	}
+	active := store.FileId
+	store.Unlock()
+	if len(stale) == 0 || len(healthy) == 0 {
+		t.Fatalf("expected both stale and healthy datafiles, got %v and %v", stale, healthy)
+	}
+
+	store.compact(context.Background())
+
+	store.Lock()
+	defer store.Unlock()
+	for _, fileId := range stale {
+		if _, ok := store.FileDir[fileId]; ok {
+			t.Fatalf("stale datafile %d was not merged", fileId)
+		}
+	}
+	for _, fileId := range healthy {
+		if _, ok := store.FileDir[fileId]; !ok {
+			t.Fatalf("healthy datafile %d was merged", fileId)
+		}
+	}
+
+	// the merged datafiles hold nothing but live records
+	for fileId := range store.FileDir {
+		if fileId > active && fileId < store.FileId {
+			if dead := store.deadBytes(fileId); dead != 0 {
+				t.Fatalf("merged datafile %d has %d dead bytes", fileId, dead)
+			}
+		}
+	}
+}
+
+func TestMergeTombstones(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir)
+	rotate := func() {
+		store.Lock()
+		defer store.Unlock()
+		if err := store.updateActiveDatafile(store.FileId + 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set := func(key, value string) {
+		if err := store.set(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tombstones := func() (n int64) {
+		store.Lock()
+		defer store.Unlock()
+		for _, size := range store.tombstones {
+			n += size
+		}
+		return n
+	}
+
+	// the deleted values sit in a healthy datafile left out of the merge
+	for i := 0; i < 3; i++ {
+		set(fmt.Sprintf("deleted%d", i), "value")
+	}
+	for i := 0; i < 10; i++ {
+		set(fmt.Sprintf("healthy%d", i), "value")
+	}
+	rotate()
+	for i := 0; i < 3; i++ {
+		if _, err := store.del(fmt.Sprintf("deleted%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		set("overwritten", fmt.Sprintf("value%d", i))
+	}
+	rotate()
+	store.hints.wait()
+
+	store.compact(context.Background())
+	if _, ok := store.FileDir[1]; !ok {
+		t.Fatal("healthy datafile was merged")
+	}
+	if tombstones() == 0 {
+		t.Fatal("tombstone hiding a value in an older datafile was dropped")
+	}
+
+	// once nothing older is left the tombstone goes away
+	for i := 0; i < 10; i++ {
+		set(fmt.Sprintf("healthy%d", i), "new")
+	}
+	rotate()
+	store.hints.wait()
+	store.compact(context.Background())
+	store.hints.wait()
+	store.compact(context.Background())
+	if n := tombstones(); n != 0 {
+		t.Fatalf("%d bytes of tombstones left after merging every older datafile", n)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store = newTestStore(t, dir)
+	defer store.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := store.get(fmt.Sprintf("deleted%d", i)); err != ErrKeyNotFound {
+			t.Fatalf("deleted key came back: %v", err)
+		}
+	}
+	if got, err := store.get("overwritten"); err != nil || string(got) != "value9" {
+		t.Fatalf("get overwritten: got %q, %v", got, err)
+	}
+}
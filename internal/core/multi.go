@@ -0,0 +1,348 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	errNestedMulti    = errors.New("ERR MULTI calls can not be nested")
+	errExecNoMulti    = errors.New("ERR EXEC without MULTI")
+	errDiscardNoMulti = errors.New("ERR DISCARD without MULTI")
+	errWatchInMulti   = errors.New("ERR WATCH inside MULTI is not allowed")
+	errBackupInMulti  = errors.New("ERR BACKUP inside MULTI is not allowed")
+	errExecAbort      = errors.New("EXECABORT Transaction discarded because of previous errors.")
+)
+
+// keyspace is what commands read and write: the store itself, or the
+// transaction EXEC runs the queued commands in.
+type keyspace interface {
+	get(key string) ([]byte, error)
+	put(key string, value []byte, expiry uint64) error
+	del(key string) (bool, error)
+	Write(b *WriteBatch) error
+	Sync() error
+	expire(key string, expiry uint64) (uint64, bool, error)
+	ttl(key string) int64
+	keys(from, end string, count int, match func(key string) bool) ([]string, string)
+	cursors() *cursorTable
+}
+
+// keyVersion returns the version of key, zero when it does not exist. The
+// caller must hold the store lock.
+func (s *Store) keyVersion(key string) uint64 {
+	if meta, ok := s.lookup(key); ok {
+		return meta.Version
+	}
+	return 0
+}
+
+// Session holds the state a client keeps between commands: the commands
+// queued since MULTI, the keys it watches and the cursors SCAN handed it. A
+// session must not be used by several goroutines at once.
+type Session struct {
+	store *Store
+	multi bool
+	// failed is set when a command could not be queued, the transaction is
+	// then discarded by EXEC.
+	failed  bool
+	queued  []*Cmd
+	watched map[string]uint64
+	// db is the keyspace commands run in, the store unless syncs are
+	// deferred. unsynced is then the count of appends the replies so far
+	// must not be sent before.
+	db       sessionStore
+	unsynced uint64
+	cursors  cursorTable
+}
+
+// sessionStore is the keyspace a session runs commands in outside of a
+// transaction.
+type sessionStore interface {
+	keyspace
+	transact(watched map[string]uint64, build func() *WriteBatch) (bool, error)
+}
+
+// sessionDB is the store as seen by a session, with the session's SCAN
+// cursors.
+type sessionDB struct {
+	*Store
+	session *Session
+}
+
+// NewSession returns a session for a client of the store.
+func (s *Store) NewSession() *Session {
+	c := &Session{store: s}
+	c.db = sessionDB{Store: s, session: c}
+	return c
+}
+
+// DeferSyncs makes the writes of the session return without waiting for the
+// syncs they would wait for, so a caller serving many clients is never held
+// up by one. The replies of the commands run since must then not be sent
+// before Unsynced appends are on disk, see Store.WaitSynced.
+func (c *Session) DeferSyncs() {
+	c.db = deferredStore{sessionDB{Store: c.store, session: c}}
+}
+
+// Unsynced returns the count of appends that must be on disk before the
+// replies of the commands run since the last call are sent, zero when they
+// need not wait.
+func (c *Session) Unsynced() uint64 {
+	seq := c.unsynced
+	c.unsynced = 0
+	return seq
+}
+
+// EvalAndResponse runs cmds in order and writes all of their replies to w in
+// a single write.
+func (c *Session) EvalAndResponse(cmds []*Cmd, w io.Writer) {
+	var buf bytes.Buffer
+	for _, cmd := range cmds {
+		buf.Write(c.executeCmd(cmd))
+	}
+	_, _ = w.Write(buf.Bytes())
+}
+
+func (c *Session) executeCmd(cmd *Cmd) []byte {
+	if c.multi {
+		switch cmd.Cmd {
+		case execCmd:
+			return c.exec(cmd.Args)
+		case discardCmd:
+			return c.discard(cmd.Args)
+		case multiCmd:
+			return Encode(errNestedMulti, false)
+		case watchCmd:
+			return Encode(errWatchInMulti, false)
+		case backupCmd:
+			c.failed = true
+			return Encode(errBackupInMulti, false)
+		case unwatchCmd:
+			// the watched keys are forgotten by EXEC anyway
+		default:
+			if !isCommand(cmd.Cmd) {
+				c.failed = true
+				return Encode(errUnknownCmd(cmd.Cmd), false)
+			}
+		}
+		c.queued = append(c.queued, cmd)
+		return RESP_QUEUED
+	}
+
+	switch cmd.Cmd {
+	case multiCmd:
+		if len(cmd.Args) != 0 {
+			return Encode(errWrongArgs(multiCmd), false)
+		}
+		c.multi = true
+		return RESP_OK
+	case execCmd:
+		return Encode(errExecNoMulti, false)
+	case discardCmd:
+		return Encode(errDiscardNoMulti, false)
+	case watchCmd:
+		return c.watch(cmd.Args)
+	case unwatchCmd:
+		c.watched = nil
+		return RESP_OK
+	case backupCmd:
+		return c.store.evalBackup(cmd.Args)
+	}
+	return executeCmd(c.db, cmd)
+}
+
+// watch records the version of every key, EXEC is aborted when one of them
+// changed by then.
+func (c *Session) watch(args [][]byte) []byte {
+	if len(args) == 0 {
+		return Encode(errWrongArgs(watchCmd), false)
+	}
+
+	if c.watched == nil {
+		c.watched = make(map[string]uint64, len(args))
+	}
+	c.store.Lock()
+	defer c.store.Unlock()
+	for _, key := range args {
+		if _, ok := c.watched[string(key)]; !ok {
+			c.watched[string(key)] = c.store.keyVersion(string(key))
+		}
+	}
+	return RESP_OK
+}
+
+func (c *Session) discard(args [][]byte) []byte {
+	if len(args) != 0 {
+		return Encode(errWrongArgs(discardCmd), false)
+	}
+	c.reset()
+	return RESP_OK
+}
+
+// exec runs the queued commands. Their writes are collected and applied in a
+// single batch, which is only written if none of the watched keys changed.
+// Reads see the writes queued before them. The commands run under the store
+// lock, so no other write slips in between what they read and what they
+// write.
+func (c *Session) exec(args [][]byte) []byte {
+	if len(args) != 0 {
+		return Encode(errWrongArgs(execCmd), false)
+	}
+	defer c.reset()
+	if c.failed {
+		return Encode(errExecAbort, false)
+	}
+
+	tx := &txn{store: c.store, session: c, pending: make(map[string]*Record)}
+	replies := make([][]byte, len(c.queued))
+	ok, err := c.db.transact(c.watched, func() *WriteBatch {
+		for i, cmd := range c.queued {
+			if cmd.Cmd == unwatchCmd {
+				replies[i] = RESP_OK
+				continue
+			}
+			replies[i] = executeCmd(tx, cmd)
+		}
+		return &tx.batch
+	})
+	if err != nil {
+		return encodeError(err)
+	}
+	if !ok {
+		return RESP_NIL_ARRAY
+	}
+	if tx.sync {
+		if err := c.db.Sync(); err != nil {
+			return encodeError(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(replies))
+	for _, reply := range replies {
+		buf.Write(reply)
+	}
+	return buf.Bytes()
+}
+
+// reset ends the transaction and forgets the watched keys.
+func (c *Session) reset() {
+	c.multi = false
+	c.failed = false
+	c.queued = nil
+	c.watched = nil
+}
+
+// txn is the keyspace of a transaction. Writes are added to a batch instead
+// of being applied, reads look at the batch before the store. It is used with
+// the store lock held and must not take it.
+type txn struct {
+	store   *Store
+	session *Session
+	batch   WriteBatch
+	// pending holds the last record the batch writes for each key.
+	pending map[string]*Record
+	// sync is set when a command asked for the batch to be synced.
+	sync bool
+}
+
+func (t *txn) add(record *Record) {
+	t.batch.records = append(t.batch.records, record)
+	t.pending[record.Key] = record
+}
+
+// read returns the record key points at in the transaction, or
+// ErrKeyNotFound.
+func (t *txn) read(key string) (*Record, error) {
+	record, ok := t.pending[key]
+	if !ok {
+		return t.store.read(key)
+	}
+	if !isLive(record) {
+		return nil, ErrKeyNotFound
+	}
+	return record, nil
+}
+
+func (t *txn) get(key string) ([]byte, error) {
+	record, err := t.read(key)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+func (t *txn) put(key string, value []byte, expiry uint64) error {
+	if t.store.cfg.ReadOnly {
+		return ErrReadOnly
+	}
+	t.add(newRecord(key, value, recordValue, expiry))
+	return nil
+}
+
+func (t *txn) del(key string) (bool, error) {
+	if _, err := t.read(key); err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if t.store.cfg.ReadOnly {
+		return false, ErrReadOnly
+	}
+	t.add(newRecord(key, nil, recordTombstone, 0))
+	return true, nil
+}
+
+func (t *txn) Write(b *WriteBatch) error {
+	if t.store.cfg.ReadOnly && len(b.records) > 0 {
+		return ErrReadOnly
+	}
+	for _, record := range b.records {
+		t.add(record)
+	}
+	return nil
+}
+
+// Sync has the batch synced once it is written.
+func (t *txn) Sync() error {
+	t.sync = true
+	return nil
+}
+
+func (t *txn) expire(key string, expiry uint64) (uint64, bool, error) {
+	if t.store.cfg.ReadOnly {
+		return 0, false, ErrReadOnly
+	}
+
+	record, err := t.read(key)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	switch {
+	case isExpired(expiry):
+		t.add(newRecord(key, nil, recordTombstone, 0))
+	case expiry != record.Expiry:
+		t.add(newRecord(key, record.Value, recordValue, expiry))
+	}
+	return record.Expiry, true, nil
+}
+
+func (t *txn) ttl(key string) int64 {
+	record, ok := t.pending[key]
+	switch {
+	case !ok:
+		return t.store.ttl(key)
+	case !isLive(record):
+		return -2
+	case record.Expiry == 0:
+		return -1
+	}
+	return timeLeft(record.Expiry)
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+)
+
+func sessionRunner(session *Session) func(args ...string) string {
+	return func(args ...string) string {
+		b := make([][]byte, len(args))
+		for i, arg := range args {
+			b[i] = []byte(arg)
+		}
+		return string(session.executeCmd(NewCmd(b)))
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+	defer store.Close()
+	run := sessionRunner(store.NewSession())
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"EXEC"}, "-ERR EXEC without MULTI\r\n"},
+		{[]string{"DISCARD"}, "-ERR DISCARD without MULTI\r\n"},
+		{[]string{"SET", "stock", "10"}, "+OK\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"MULTI"}, "-ERR MULTI calls can not be nested\r\n"},
+		{[]string{"SET", "stock", "9"}, "+QUEUED\r\n"},
+		{[]string{"GET", "stock"}, "+QUEUED\r\n"},
+		{[]string{"DEL", "stock", "missing"}, "+QUEUED\r\n"},
+		{[]string{"TTL", "stock"}, "+QUEUED\r\n"},
+		{[]string{"SET", "order", "1", "EX", "100"}, "+QUEUED\r\n"},
+		{[]string{"TTL", "order"}, "+QUEUED\r\n"},
+		{[]string{"EXEC"}, "*6\r\n+OK\r\n$1\r\n9\r\n:1\r\n:-2\r\n+OK\r\n:100\r\n"},
+		{[]string{"GET", "stock"}, "$-1\r\n"},
+		{[]string{"GET", "order"}, "$1\r\n1\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "order", "2"}, "+QUEUED\r\n"},
+		{[]string{"DISCARD"}, "+OK\r\n"},
+		{[]string{"GET", "order"}, "$1\r\n1\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "order", "3"}, "+QUEUED\r\n"},
+		{[]string{"INCR", "order"}, "-ERR unknown command 'incr'\r\n"},
+		{[]string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors.\r\n"},
+		{[]string{"GET", "order"}, "$1\r\n1\r\n"},
+	} {
+		if got := run(tc.args...); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	store := newTestStore(t, t.TempDir(), config.WithMergeDeadRatio(0.1))
+	defer store.Close()
+	run := sessionRunner(store.NewSession())
+	other := sessionRunner(store.NewSession())
+
+	transfer := func() string {
+		run("MULTI")
+		run("SET", "stock", "9")
+		run("SET", "reserved", "1")
+		return run("EXEC")
+	}
+
+	run("SET", "stock", "10")
+	run("WATCH", "stock", "reserved")
+	other("SET", "stock", "10")
+	if got := transfer(); got != "*-1\r\n" {
+		t.Fatalf("exec after a watched key changed: got %q", got)
+	}
+	if got := other("GET", "reserved"); got != "$-1\r\n" {
+		t.Fatalf("aborted transaction was applied: %q", got)
+	}
+
+	// a key created after it was watched counts as changed too
+	run("WATCH", "stock", "reserved")
+	other("SET", "reserved", "0")
+	if got := transfer(); got != "*-1\r\n" {
+		t.Fatalf("exec after a watched key was created: got %q", got)
+	}
+
+	// a merge moving a key does not change it
+	run("WATCH", "stock", "reserved")
+	store.Lock()
+	if err := store.updateActiveDatafile(store.FileId + 1); err != nil {
+		t.Fatal(err)
+	}
+	store.Unlock()
+	store.hints.wait()
+	store.compact(context.Background())
+	if _, ok := store.FileDir[1]; ok {
+		t.Fatal("datafile was not merged")
+	}
+	if got := transfer(); got != "*2\r\n+OK\r\n+OK\r\n" {
+		t.Fatalf("exec with unchanged watched keys: got %q", got)
+	}
+	if got := other("GET", "stock"); got != "$1\r\n9\r\n" {
+		t.Fatalf("get stock: got %q", got)
+	}
+
+	// EXEC forgets the watched keys
+	other("SET", "stock", "8")
+	if got := transfer(); got != "*2\r\n+OK\r\n+OK\r\n" {
+		t.Fatalf("exec after the watch ended: got %q", got)
+	}
+}
+
+func TestExecIsolation(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+	defer store.Close()
+	run := sessionRunner(store.NewSession())
+
+	const writes = 2000
+	if err := store.Put("key", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= writes; i++ {
+			if err := store.Put("key", []byte(strconv.Itoa(i))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// every EXPIRE writes back the value it read, a SET between the read and
+	// the write would be lost
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			if got := run("GET", "key"); got != "$4\r\n2000\r\n" {
+				t.Fatalf("got %q after the last write, a write was lost", got)
+			}
+			return
+		default:
+		}
+		run("MULTI")
+		run("EXPIRE", "key", strconv.Itoa(1000+i%2))
+		run("DEL", "missing")
+		if got := run("EXEC"); got != "*2\r\n:1\r\n:0\r\n" {
+			t.Fatalf("exec: got %q", got)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/maphash"
+	"maps"
+	"math/bits"
+	"math/rand"
+	"slices"
+
+	"github.com/ajaxchavan/bytecask/internal/btree"
+)
+
+const (
+	// slabSize is the size of the slabs a packedKeyDir stores its entries in.
+	// An entry larger than a slab gets a slab of its own.
+	slabSize = 4 << 20
+	// packedMetaSize is the size of an encoded Meta.
+	packedMetaSize = 32
+	// deletedSlot marks a slot whose key was deleted, a lookup goes on past it.
+	deletedSlot = ^uint64(0)
+)
+
+// packedKeyDir keeps its entries in large byte slabs instead of on the heap,
+// so it costs a few dozen bytes per key on top of the key itself and gives
+// the garbage collector next to nothing to scan. An entry is the encoded Meta
+// followed by the length of the key and the key, and is referred to by the
+// index of its slab in the upper 32 bits and its offset in the lower ones.
+//
+// Lookups go through an open addressing table of references. The order of
+// the keys is kept by a B-tree of references compared by the keys they point
+// at. Entries are updated in place; deleted ones leave a hole, the slabs are
+// compacted once holes take more room than entries.
+//
+// The keys that have an expiry are listed by reference too, next to a map
+// from each reference to its place in the list. Neither holds pointers, the
+// garbage collector does not scan them either.
+type packedKeyDir struct {
+	seed  maphash.Seed
+	slabs [][]byte
+	// slots holds one more than the reference of the entry in it, zero for
+	// a free slot. hashes holds the lower half of the hash of its key.
+	slots   []uint64
+	hashes  []uint32
+	count   int
+	deleted int
+	// live and dead are the bytes of the slabs taken by entries and by
+	// holes.
+	live  int64
+	dead  int64
+	index *btree.BTree[uint64]
+	// expiring holds the references of the entries with an expiry, in no
+	// particular order. expiringAt maps each of them to its index.
+	expiring   []uint64
+	expiringAt map[uint64]int
+}
+
+func newPackedKeyDir() *packedKeyDir {
+	d := &packedKeyDir{seed: maphash.MakeSeed()}
+	d.index = btree.NewFunc(d.compare)
+	return d
+}
+
+func (d *packedKeyDir) Get(key string) (Meta, bool) {
+	i, ok := d.find(key, d.hash(key))
+	if !ok {
+		return Meta{}, false
+	}
+	return decodeMeta(d.entry(d.slots[i] - 1)), true
+}
+
+func (d *packedKeyDir) Put(key string, meta Meta) {
+	h := d.hash(key)
+	i, ok := d.find(key, h)
+	if ok {
+		ref := d.slots[i] - 1
+		switch expiry := decodeMeta(d.entry(ref)).Expiry; {
+		case meta.Expiry != 0 && expiry == 0:
+			d.addExpiring(ref)
+		case meta.Expiry == 0 && expiry != 0:
+			d.removeExpiring(ref)
+		}
+		encodeMeta(d.entry(ref), &meta)
+		return
+	}
+	if (d.count+d.deleted+1)*4 > len(d.slots)*3 {
+		d.rehash(d.count + 1)
+		i, _ = d.find(key, h)
+	}
+
+	size := packedMetaSize + uvarintLen(len(key)) + len(key)
+	ref, b := d.alloc(&d.slabs, size)
+	encodeMeta(b, &meta)
+	n := binary.PutUvarint(b[packedMetaSize:], uint64(len(key)))
+	copy(b[packedMetaSize+n:], key)
+	d.live += int64(size)
+
+	if d.slots[i] == deletedSlot {
+		d.deleted--
+	}
+	d.slots[i], d.hashes[i] = ref+1, uint32(h)
+	d.count++
+	d.index.Insert(ref)
+	if meta.Expiry != 0 {
+		d.addExpiring(ref)
+	}
+}
+
+func (d *packedKeyDir) Delete(key string) {
+	i, ok := d.find(key, d.hash(key))
+	if !ok {
+		return
+	}
+	ref := d.slots[i] - 1
+	d.index.Delete(ref)
+	if decodeMeta(d.entry(ref)).Expiry != 0 {
+		d.removeExpiring(ref)
+	}
+	d.slots[i], d.hashes[i] = deletedSlot, 0
+	d.count--
+	d.deleted++
+
+	size := int64(d.entrySize(ref))
+	d.live -= size
+	d.dead += size
+	if d.dead > slabSize && d.dead > d.live {
+		d.compact()
+	}
+}
+
+func (d *packedKeyDir) Len() int {
+	return d.count
+}
+
+func (d *packedKeyDir) Ascend(from string, fn func(key string, meta Meta) bool) {
+	start := []byte(from)
+	d.index.AscendFunc(func(ref uint64) int {
+		return bytes.Compare(d.key(ref), start)
+	}, func(ref uint64) bool {
+		return fn(string(d.key(ref)), decodeMeta(d.entry(ref)))
+	})
+}
+
+func (d *packedKeyDir) Clone() KeyDir {
+	c := &packedKeyDir{
+		seed:       d.seed,
+		slabs:      make([][]byte, len(d.slabs)),
+		slots:      slices.Clone(d.slots),
+		hashes:     slices.Clone(d.hashes),
+		count:      d.count,
+		deleted:    d.deleted,
+		live:       d.live,
+		dead:       d.dead,
+		expiring:   slices.Clone(d.expiring),
+		expiringAt: maps.Clone(d.expiringAt),
+	}
+	for i, slab := range d.slabs {
+		c.slabs[i] = slices.Clone(slab)
+	}
+	c.index = d.index.Clone(c.compare)
+	return c
+}
+
+// SampleExpiring picks each key at random, the same key may come up more
+// than once.
+func (d *packedKeyDir) SampleExpiring(n int) []string {
+	if len(d.expiring) <= n {
+		keys := make([]string, len(d.expiring))
+		for i, ref := range d.expiring {
+			keys[i] = string(d.key(ref))
+		}
+		return keys
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = string(d.key(d.expiring[rand.Intn(len(d.expiring))]))
+	}
+	return keys
+}
+
+// addExpiring lists the entry ref refers to as having an expiry.
+func (d *packedKeyDir) addExpiring(ref uint64) {
+	if d.expiringAt == nil {
+		d.expiringAt = make(map[uint64]int)
+	}
+	d.expiringAt[ref] = len(d.expiring)
+	d.expiring = append(d.expiring, ref)
+}
+
+// removeExpiring takes the entry ref refers to off the list of entries with
+// an expiry, the last one on the list takes its place.
+func (d *packedKeyDir) removeExpiring(ref uint64) {
+	i, ok := d.expiringAt[ref]
+	if !ok {
+		return
+	}
+	last := d.expiring[len(d.expiring)-1]
+	d.expiring[i], d.expiringAt[last] = last, i
+	d.expiring = d.expiring[:len(d.expiring)-1]
+	delete(d.expiringAt, ref)
+}
+
+func (d *packedKeyDir) hash(key string) uint64 {
+	return maphash.String(d.seed, key)
+}
+
+// find returns the slot holding key and true, or the slot to put key in and
+// false.
+func (d *packedKeyDir) find(key string, h uint64) (int, bool) {
+	if len(d.slots) == 0 {
+		return 0, false
+	}
+	mask := uint64(len(d.slots) - 1)
+	free := -1
+	for i := h & mask; ; i = (i + 1) & mask {
+		switch slot := d.slots[i]; {
+		case slot == 0:
+			if free < 0 {
+				free = int(i)
+			}
+			return free, false
+		case slot == deletedSlot:
+			if free < 0 {
+				free = int(i)
+			}
+		case d.hashes[i] == uint32(h) && string(d.key(slot-1)) == key:
+			return int(i), true
+		}
+	}
+}
+
+// rehash sizes the table for n keys, dropping the deleted slots.
+func (d *packedKeyDir) rehash(n int) {
+	size := max(16, 1<<bits.Len(uint(n*2)))
+	slots, hashes := d.slots, d.hashes
+	d.slots, d.hashes = make([]uint64, size), make([]uint32, size)
+	d.deleted = 0
+	for i, slot := range slots {
+		if slot != 0 && slot != deletedSlot {
+			d.insertSlot(slot, hashes[i])
+		}
+	}
+}
+
+// insertSlot puts slot in the first free slot from where its hash leads.
+func (d *packedKeyDir) insertSlot(slot uint64, h uint32) {
+	mask := uint64(len(d.slots) - 1)
+	i := uint64(h) & mask
+	for d.slots[i] != 0 {
+		i = (i + 1) & mask
+	}
+	d.slots[i], d.hashes[i] = slot, h
+}
+
+// compact copies the entries into new slabs, leaving the holes behind.
+func (d *packedKeyDir) compact() {
+	var slabs [][]byte
+	d.slots, d.hashes = make([]uint64, len(d.slots)), make([]uint32, len(d.hashes))
+	d.deleted = 0
+	d.expiring, d.expiringAt = d.expiring[:0], nil
+	d.index.Rewrite(func(ref uint64) uint64 {
+		size := d.entrySize(ref)
+		moved, b := d.alloc(&slabs, size)
+		copy(b, d.entry(ref)[:size])
+		d.insertSlot(moved+1, uint32(d.hash(string(d.key(ref)))))
+		if decodeMeta(b).Expiry != 0 {
+			d.addExpiring(moved)
+		}
+		return moved
+	})
+	d.slabs = slabs
+	d.dead = 0
+}
+
+// alloc takes size bytes from the last of slabs, or from a new slab if they
+// do not fit, and returns their reference.
+func (d *packedKeyDir) alloc(slabs *[][]byte, size int) (uint64, []byte) {
+	n := len(*slabs)
+	if n == 0 || len((*slabs)[n-1])+size > cap((*slabs)[n-1]) {
+		*slabs = append(*slabs, make([]byte, 0, max(slabSize, size)))
+		n++
+	}
+	slab := (*slabs)[n-1]
+	off := len(slab)
+	(*slabs)[n-1] = slab[:off+size]
+	return uint64(n-1)<<32 | uint64(off), slab[off : off+size]
+}
+
+// entry returns the slab from the entry ref refers to on.
+func (d *packedKeyDir) entry(ref uint64) []byte {
+	return d.slabs[ref>>32][uint32(ref):]
+}
+
+// key returns the key of the entry ref refers to.
+func (d *packedKeyDir) key(ref uint64) []byte {
+	b := d.entry(ref)[packedMetaSize:]
+	n, w := binary.Uvarint(b)
+	return b[w : w+int(n)]
+}
+
+func (d *packedKeyDir) entrySize(ref uint64) int {
+	n, w := binary.Uvarint(d.entry(ref)[packedMetaSize:])
+	return packedMetaSize + w + int(n)
+}
+
+// compare orders references by their keys.
+func (d *packedKeyDir) compare(a, b uint64) int {
+	return bytes.Compare(d.key(a), d.key(b))
+}
+
+func encodeMeta(b []byte, meta *Meta) {
+	binary.LittleEndian.PutUint32(b[0:], meta.Timestamp)
+	binary.LittleEndian.PutUint32(b[4:], meta.Offset)
+	binary.LittleEndian.PutUint32(b[8:], meta.ObjectSize)
+	binary.LittleEndian.PutUint32(b[12:], uint32(meta.FileId))
+	binary.LittleEndian.PutUint64(b[16:], meta.Expiry)
+	binary.LittleEndian.PutUint64(b[24:], meta.Version)
+}
+
+func decodeMeta(b []byte) Meta {
+	return Meta{
+		Timestamp:  binary.LittleEndian.Uint32(b[0:]),
+		Offset:     binary.LittleEndian.Uint32(b[4:]),
+		ObjectSize: binary.LittleEndian.Uint32(b[8:]),
+		FileId:     int(binary.LittleEndian.Uint32(b[12:])),
+		Expiry:     binary.LittleEndian.Uint64(b[16:]),
+		Version:    binary.LittleEndian.Uint64(b[24:]),
+	}
+}
+
+func uvarintLen(n int) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], uint64(n))
+}
@@ -1,7 +1,66 @@
 package core
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+)
 
-func Encode(value interface{}) []byte {
-	return []byte(fmt.Sprintf("%s\r\n", value))
+var (
+	RESP_OK   = []byte("+OK\r\n")
+	RESP_NIL  = []byte("$-1\r\n")
+	RESP_ONE  = []byte(":1\r\n")
+	RESP_ZERO = []byte(":0\r\n")
+	// RESP_QUEUED is the reply to a command queued by MULTI.
+	RESP_QUEUED = []byte("+QUEUED\r\n")
+	// RESP_NIL_ARRAY is the reply to an EXEC aborted by WATCH.
+	RESP_NIL_ARRAY = []byte("*-1\r\n")
+)
+
+// Encode serializes value as a RESP2 reply. Strings are written as simple
+// strings when isSimple is set and as bulk strings otherwise, a nil value is
+// the null bulk reply and errors are written as error replies.
+func Encode(value interface{}, isSimple bool) []byte {
+	switch v := value.(type) {
+	case nil:
+		return RESP_NIL
+	case string:
+		if isSimple {
+			return []byte(fmt.Sprintf("+%s\r\n", v))
+		}
+		return encodeBulk([]byte(v))
+	case []byte:
+		if v == nil {
+			return RESP_NIL
+		}
+		return encodeBulk(v)
+	case int:
+		return []byte(fmt.Sprintf(":%d\r\n", v))
+	case int64:
+		return []byte(fmt.Sprintf(":%d\r\n", v))
+	case error:
+		return []byte(fmt.Sprintf("-%s\r\n", v))
+	case []string:
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("*%d\r\n", len(v)))
+		for _, s := range v {
+			buf.Write(encodeBulk([]byte(s)))
+		}
+		return buf.Bytes()
+	case []interface{}:
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("*%d\r\n", len(v)))
+		for _, e := range v {
+			buf.Write(Encode(e, false))
+		}
+		return buf.Bytes()
+	default:
+		return Encode(fmt.Errorf("ERR unsupported reply type %T", v), false)
+	}
+}
+
+func encodeBulk(v []byte) []byte {
+	buf := make([]byte, 0, len(v)+16)
+	buf = append(buf, fmt.Sprintf("$%d\r\n", len(v))...)
+	buf = append(buf, v...)
+	return append(buf, '\r', '\n')
 }
@@ -0,0 +1,296 @@
+package core
+
+import (
+	"errors"
+	"sort"
+)
+
+const (
+	// iteratorBatch is the number of keys an iterator looks at in one go.
+	iteratorBatch = 256
+	// maxCursors is the number of SCAN cursors a session remembers, the oldest
+	// ones are forgotten first.
+	maxCursors = 1 << 10
+)
+
+// keys returns the live keys from from on, and before end unless it is
+// empty, that match. It looks at no more than count keys and returns the key
+// to go on from, empty once the range is exhausted. Keys written meanwhile
+// are seen by the next call if they sort after where it goes on from.
+func (s *Store) keys(from, end string, count int, match func(key string) bool) ([]string, string) {
+	var (
+		keys []string
+		next string
+		seen int
+	)
+	s.KeyDir.Ascend(from, func(key string, meta Meta) bool {
+		if end != "" && key >= end {
+			return false
+		}
+		if seen == count {
+			next = key
+			return false
+		}
+		seen++
+		if !isExpired(meta.Expiry) && (match == nil || match(key)) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, next
+}
+
+// cursors returns the SCAN cursors of the session.
+func (d sessionDB) cursors() *cursorTable {
+	return &d.session.cursors
+}
+
+// keys returns the keys of the range like Store.keys, as the transaction has
+// changed them so far.
+func (t *txn) keys(from, end string, count int, match func(key string) bool) ([]string, string) {
+	keys, next := t.store.keys(from, end, count, match)
+
+	covered := func(key string) bool {
+		return key >= from && (next == "" || key < next) && (end == "" || key < end)
+	}
+	live := keys[:0]
+	for _, key := range keys {
+		if record, ok := t.pending[key]; !ok || isLive(record) {
+			live = append(live, key)
+		}
+	}
+	keys = live
+	for key, record := range t.pending {
+		if !isLive(record) || !covered(key) || (match != nil && !match(key)) {
+			continue
+		}
+		if i := sort.SearchStrings(keys, key); i == len(keys) || keys[i] != key {
+			keys = append(keys, "")
+			copy(keys[i+1:], keys[i:])
+			keys[i] = key
+		}
+	}
+	return keys, next
+}
+
+func (t *txn) cursors() *cursorTable {
+	return &t.session.cursors
+}
+
+// isLive reports whether a record written by a transaction leaves its key
+// with a value.
+func isLive(record *Record) bool {
+	return record.Type == recordValue && !isExpired(record.Expiry)
+}
+
+// cursorTable maps the cursors handed out by SCAN to the key the scan goes on
+// from. Keys are visited in order, so a scan sees every key that exists from
+// its start to its end whatever is written meanwhile. Each session has its
+// own, so the scans of other clients never evict its cursors.
+type cursorTable struct {
+	last  uint64
+	keys  map[uint64]string
+	order []uint64
+}
+
+// add returns a new cursor going on from key.
+func (c *cursorTable) add(key string) uint64 {
+	if c.keys == nil {
+		c.keys = make(map[uint64]string)
+	}
+	if len(c.order) >= maxCursors {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.last++
+	c.keys[c.last] = key
+	c.order = append(c.order, c.last)
+	return c.last
+}
+
+// get returns the key the cursor goes on from.
+func (c *cursorTable) get(cursor uint64) (string, bool) {
+	key, ok := c.keys[cursor]
+	return key, ok
+}
+
+// iterSource is what an iterator walks: the store or a snapshot of it.
+type iterSource interface {
+	keys(from, end string, count int, match func(key string) bool) ([]string, string)
+	get(key string) ([]byte, error)
+}
+
+// Iterator walks the keys of a range in order along with their values. It
+// does not hold the store lock between calls to Next, keys written meanwhile
+// are seen if they sort after the current key.
+type Iterator struct {
+	src iterSource
+	// next is the key to go on from once keys is used up, done is set when
+	// the range is exhausted.
+	next  string
+	end   string
+	keys  []string
+	done  bool
+	key   string
+	value []byte
+	err   error
+}
+
+// Iterator returns an iterator over the keys from start on and before end,
+// end being empty for no bound.
+func (s *Store) Iterator(start, end string) *Iterator {
+	return &Iterator{src: s, next: start, end: end}
+}
+
+// Prefix returns an iterator over the keys starting with prefix.
+func (s *Store) Prefix(prefix string) *Iterator {
+	return s.Iterator(prefix, prefixEnd(prefix))
+}
+
+// Next moves to the next key and reports whether there is one.
+func (it *Iterator) Next() bool {
+	for it.err == nil {
+		if len(it.keys) == 0 {
+			if it.done {
+				return false
+			}
+			it.keys, it.next = it.src.keys(it.next, it.end, iteratorBatch, nil)
+			it.done = it.next == ""
+			continue
+		}
+
+		key := it.keys[0]
+		it.keys = it.keys[1:]
+		value, err := it.src.get(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			// deleted since it was listed
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.key, it.value = key, value
+		return true
+	}
+	return false
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value of the current key.
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// prefixEnd returns the first key after every key starting with prefix,
+// empty when there is none.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// patternPrefix returns the part of a glob pattern before its first special
+// character, every key it matches starts with it.
+func patternPrefix(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
+
+// matchPattern reports whether key matches the glob pattern the way KEYS
+// does: * matches any run of bytes, ? any single byte, [...] a set of bytes
+// with ranges and ^ for negation, and \ escapes the next character. Only the
+// last * is ever backtracked to, which keeps a match linear in the length of
+// the key for any given pattern.
+func matchPattern(pattern, key string) bool {
+	p, k := 0, 0
+	// star is where the pattern goes on after the last *, starKey where in
+	// the key that * stopped matching
+	star, starKey := -1, 0
+	for k < len(key) {
+		if p < len(pattern) && pattern[p] == '*' {
+			p++
+			star, starKey = p, k
+			continue
+		}
+		if p < len(pattern) {
+			if ok, n := matchByte(pattern[p:], key[k]); ok {
+				p += n
+				k++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// let the last * take one more byte and go on from there
+		starKey++
+		p, k = star, starKey
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchByte reports whether c matches the element at the start of pattern,
+// which is not a *, and returns the number of bytes the element takes up. An
+// unterminated set takes up the rest of the pattern.
+func matchByte(pattern string, c byte) (bool, int) {
+	switch pattern[0] {
+	case '?':
+		return true, 1
+	case '[':
+		i := 1
+		not := i < len(pattern) && pattern[i] == '^'
+		if not {
+			i++
+		}
+		matched := false
+		for i < len(pattern) && pattern[i] != ']' {
+			switch {
+			case pattern[i] == '\\' && i+1 < len(pattern):
+				matched = matched || pattern[i+1] == c
+				i += 2
+			case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+				lo, hi := pattern[i], pattern[i+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				matched = matched || (lo <= c && c <= hi)
+				i += 3
+			default:
+				matched = matched || pattern[i] == c
+				i++
+			}
+		}
+		if i < len(pattern) {
+			i++
+		}
+		return matched != not, i
+	case '\\':
+		if len(pattern) > 1 {
+			return pattern[1] == c, 2
+		}
+	}
+	return pattern[0] == c, 1
+}
@@ -0,0 +1,162 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"key[0-9]*:x", "key42:x", true},
+		{"*:x", "key42:y", false},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*a*b", "xaxaxb", true},
+		{"*a*b", "xaxax", false},
+		{"a*", "a", true},
+		{"*?", "", false},
+		{"a**?c", "abbc", true},
+		{"[a", "a", true},
+		{"[a", "ab", false},
+		{"[a]*", "abc", true},
+		{`a\`, `a\`, true},
+		{"*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 200), false},
+	} {
+		if got := matchPattern(tc.pattern, tc.key); got != tc.want {
+			t.Errorf("match %q against %q: got %v", tc.key, tc.pattern, got)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+	defer store.Close()
+	run := sessionRunner(store.NewSession())
+
+	for i := 0; i < 3000; i++ {
+		if err := store.set(fmt.Sprintf("user:%04d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("SET", "order:1", "v")
+	if err := store.put("user:0001", []byte("v"), 1); err != nil {
+		t.Fatal(err)
+	}
+	run("DEL", "user:0002")
+
+	if got := run("KEYS", "user:000*"); got != "*8\r\n$9\r\nuser:0000\r\n$9\r\nuser:0003\r\n$9\r\nuser:0004\r\n$9\r\nuser:0005\r\n$9\r\nuser:0006\r\n$9\r\nuser:0007\r\n$9\r\nuser:0008\r\n$9\r\nuser:0009\r\n" {
+		t.Fatalf("keys user:000*: got %q", got)
+	}
+	if got := run("KEYS", "*:1"); got != "*1\r\n$7\r\norder:1\r\n" {
+		t.Fatalf("keys *:1: got %q", got)
+	}
+
+	// a transaction sees its own writes
+	run("MULTI")
+	run("SET", "order:2", "v")
+	run("DEL", "order:1")
+	run("KEYS", "order:*")
+	if got := run("EXEC"); got != "*3\r\n+OK\r\n:1\r\n*1\r\n$7\r\norder:2\r\n" {
+		t.Fatalf("keys in a transaction: got %q", got)
+	}
+}
+
+func TestScan(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+	defer store.Close()
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		if err := store.set(fmt.Sprintf("key%04d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scanner := func(session *Session) func(args ...string) (string, []string) {
+		run := sessionRunner(session)
+		return func(args ...string) (string, []string) {
+			t.Helper()
+			// the reply is the cursor followed by an array of keys
+			reply := run(append([]string{"SCAN"}, args...)...)
+			lines := strings.Split(reply, "\r\n")
+			if len(lines) < 5 || lines[0] != "*2" {
+				t.Fatalf("scan %q: got %q", args, reply)
+			}
+			var keys []string
+			for i := 5; i < len(lines); i += 2 {
+				keys = append(keys, lines[i])
+			}
+			return lines[2], keys
+		}
+	}
+	scan := scanner(store.NewSession())
+
+	// every key there from start to end is returned exactly once while keys
+	// are added and removed
+	seen := make(map[string]int)
+	cursor := "0"
+	for round := 0; ; round++ {
+		var keys []string
+		cursor, keys = scan(cursor, "COUNT", "37")
+		for _, key := range keys {
+			seen[key]++
+		}
+		if err := store.set(fmt.Sprintf("key%04d", 2000+round), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.del(fmt.Sprintf("key%04d", n-1-round)); err != nil {
+			t.Fatal(err)
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	for i := 0; i < n/2; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		if seen[key] != 1 {
+			t.Fatalf("%s seen %d times", key, seen[key])
+		}
+	}
+	for key, times := range seen {
+		if times != 1 {
+			t.Fatalf("%s seen %d times", key, times)
+		}
+	}
+
+	_, keys := scan("0", "MATCH", "key00[0-4]?", "COUNT", "1000")
+	if !sort.StringsAreSorted(keys) || len(keys) != 50 {
+		t.Fatalf("scan with match: got %d keys", len(keys))
+	}
+	if got := string(store.executeCmd(NewCmd([][]byte{[]byte("SCAN"), []byte("12345678")}))); got != "-ERR invalid cursor\r\n" {
+		t.Fatalf("scan with an unknown cursor: got %q", got)
+	}
+
+	// the scans of other sessions neither see nor evict the cursors of one
+	other := store.NewSession()
+	cursor, _ = scan("0", "COUNT", "10")
+	scanOther := scanner(other)
+	for i := 0; i <= maxCursors; i++ {
+		scanOther("0", "COUNT", "10")
+	}
+	if got := sessionRunner(store.NewSession())("SCAN", cursor); got != "-ERR invalid cursor\r\n" {
+		t.Fatalf("scan with the cursor of another session: got %q", got)
+	}
+	if _, keys = scan(cursor, "COUNT", "10"); len(keys) != 10 || keys[0] != "key0010" {
+		t.Fatalf("scan after other sessions scanned: got %q", keys)
+	}
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"hash/maphash"
+	"math/rand"
+	"sync"
+)
+
+// ascendBatch is the number of keys Ascend takes from a shard at a time.
+const ascendBatch = 128
+
+// shardedKeyDir spreads the keys over shards by hash, each a key directory
+// behind its own read-write lock, so lookups never wait on lookups and only
+// wait on a change to a key of the same shard. Changes come from under the
+// store lock, which keeps them in the order of the datafiles.
+type shardedKeyDir struct {
+	seed   maphash.Seed
+	shards []keyDirShard
+}
+
+type keyDirShard struct {
+	sync.RWMutex
+	dir KeyDir
+	// keeps the locks of neighbouring shards off the same cache line
+	_ [64]byte
+}
+
+func newShardedKeyDir(shards int, compact bool) *shardedKeyDir {
+	d := &shardedKeyDir{seed: maphash.MakeSeed(), shards: make([]keyDirShard, max(1, shards))}
+	for i := range d.shards {
+		d.shards[i].dir = newKeyDir(compact)
+	}
+	return d
+}
+
+func (d *shardedKeyDir) shard(key string) *keyDirShard {
+	return &d.shards[maphash.String(d.seed, key)%uint64(len(d.shards))]
+}
+
+func (d *shardedKeyDir) Get(key string) (Meta, bool) {
+	sh := d.shard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	return sh.dir.Get(key)
+}
+
+func (d *shardedKeyDir) Put(key string, meta Meta) {
+	sh := d.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	sh.dir.Put(key, meta)
+}
+
+func (d *shardedKeyDir) Delete(key string) {
+	sh := d.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	sh.dir.Delete(key)
+}
+
+func (d *shardedKeyDir) Len() int {
+	n := 0
+	for i := range d.shards {
+		sh := &d.shards[i]
+		sh.RLock()
+		n += sh.dir.Len()
+		sh.RUnlock()
+	}
+	return n
+}
+
+// Ascend merges the keys of the shards in order. A shard is only locked
+// while a batch of its keys is taken, so unlike the other key directories it
+// may be changed meanwhile: fn sees a key written meanwhile if it sorts after
+// the batch taken from its shard.
+func (d *shardedKeyDir) Ascend(from string, fn func(key string, meta Meta) bool) {
+	cursors := make([]shardCursor, len(d.shards))
+	for i := range cursors {
+		cursors[i] = shardCursor{shard: &d.shards[i], from: from}
+	}
+	for {
+		var next *shardCursor
+		for i := range cursors {
+			c := &cursors[i]
+			if !c.peek() {
+				continue
+			}
+			if next == nil || c.keys[0] < next.keys[0] {
+				next = c
+			}
+		}
+		if next == nil {
+			return
+		}
+		key, meta := next.keys[0], next.metas[0]
+		next.keys, next.metas = next.keys[1:], next.metas[1:]
+		if !fn(key, meta) {
+			return
+		}
+	}
+}
+
+func (d *shardedKeyDir) Clone() KeyDir {
+	c := &shardedKeyDir{seed: d.seed, shards: make([]keyDirShard, len(d.shards))}
+	for i := range d.shards {
+		sh := &d.shards[i]
+		sh.RLock()
+		c.shards[i].dir = sh.dir.Clone()
+		sh.RUnlock()
+	}
+	return c
+}
+
+// SampleExpiring takes its sample from the shards in turn, from a random one
+// on. A shard is read locked while its part of the sample is taken.
+func (d *shardedKeyDir) SampleExpiring(n int) []string {
+	var keys []string
+	per := max(1, n/len(d.shards))
+	start := rand.Intn(len(d.shards))
+	for i := 0; i < len(d.shards) && len(keys) < n; i++ {
+		sh := &d.shards[(start+i)%len(d.shards)]
+		sh.RLock()
+		keys = append(keys, sh.dir.SampleExpiring(min(per, n-len(keys)))...)
+		sh.RUnlock()
+	}
+	return keys
+}
+
+// shardCursor walks the keys of a shard in batches.
+type shardCursor struct {
+	shard *keyDirShard
+	// from is where the next batch starts, done is set once the shard is
+	// exhausted.
+	from  string
+	done  bool
+	keys  []string
+	metas []Meta
+}
+
+// peek makes sure the cursor has a key at hand and reports whether it has.
+func (c *shardCursor) peek() bool {
+	if len(c.keys) > 0 {
+		return true
+	}
+	if c.done {
+		return false
+	}
+
+	c.shard.RLock()
+	c.shard.dir.Ascend(c.from, func(key string, meta Meta) bool {
+		c.keys = append(c.keys, key)
+		c.metas = append(c.metas, meta)
+		return len(c.keys) < ascendBatch
+	})
+	c.shard.RUnlock()
+
+	if len(c.keys) < ascendBatch {
+		c.done = true
+	} else {
+		// the smallest key after the last one
+		c.from = c.keys[len(c.keys)-1] + "\x00"
+	}
+	return len(c.keys) > 0
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+)
+
+func TestConcurrentReads(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		t.Run(fmt.Sprintf("mmap=%v", mmap), func(t *testing.T) {
+			testConcurrentReads(t, mmap)
+		})
+	}
+}
+
+// testConcurrentReads reads and scans the keys while they are written and
+// merged. With mmap the values are viewed in place in the mapped datafiles,
+// which merges unmap.
+func testConcurrentReads(t *testing.T, mmap bool) {
+	store := newTestStore(t, t.TempDir(), config.WithMaxDatafileSize(1024), config.WithMergeDeadRatio(0.1), config.WithMmapReads(mmap))
+	defer store.Close()
+
+	const keys = 64
+	for i := 0; i < keys; i++ {
+		if err := store.set(fmt.Sprintf("key%02d", i), []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		done atomic.Bool
+	)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for !done.Load() {
+				key := fmt.Sprintf("key%02d", r.Intn(keys))
+				err := store.View(key, func(value []byte) error {
+					if _, err := strconv.Atoi(string(value)); err != nil {
+						return fmt.Errorf("got %q", value)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Errorf("view %s: %v", key, err)
+					return
+				}
+				if n, _ := store.keys("", "", keys, nil); len(n) != keys {
+					t.Errorf("keys: got %d, want %d", len(n), keys)
+					return
+				}
+			}
+		}(int64(g))
+	}
+
+	for i := 1; i <= 60; i++ {
+		for k := 0; k < keys; k++ {
+			if err := store.set(fmt.Sprintf("key%02d", k), []byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i%10 == 0 {
+			store.hints.wait()
+			store.compact(context.Background())
+		}
+	}
+	done.Store(true)
+	wg.Wait()
+
+	for k := 0; k < keys; k++ {
+		if got, err := store.get(fmt.Sprintf("key%02d", k)); err != nil || string(got) != "60" {
+			t.Fatalf("get key%02d: got %q, %v", k, got, err)
+		}
+	}
+}
+
+// BenchmarkParallel reads, and writes one time in ten, keys spread over the
+// key directory from every goroutine. Compare the shard counts with
+//
+//	go test ./internal/core -run '^$' -bench Parallel -cpu 1,2,4,8,16
+func BenchmarkParallel(b *testing.B) {
+	const keys = 1 << 16
+	value := make([]byte, 64)
+	for _, shards := range []int{1, 32} {
+		for _, writes := range []int{0, 10} {
+			b.Run(fmt.Sprintf("shards=%d/writes=%d%%", shards, writes), func(b *testing.B) {
+				store := newTestStore(b, b.TempDir(), config.WithKeyDirShards(shards))
+				defer store.Close()
+				for i := 0; i < keys; i++ {
+					if err := store.set("key:"+strconv.Itoa(i), value); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				var seed atomic.Int64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					r := rand.New(rand.NewSource(seed.Add(1)))
+					for pb.Next() {
+						key := "key:" + strconv.Itoa(r.Intn(keys))
+						var err error
+						if r.Intn(100) < writes {
+							err = store.set(key, value)
+						} else {
+							_, err = store.get(key)
+						}
+						if err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/ajaxchavan/bytecask/internal/datafile"
+)
+
+// Snapshot is a read-only view of the store as it was when the snapshot was
+// taken. It keeps a copy of the key directory and a reference on every
+// datafile the copy points into, a merge leaves those datafiles on disk until
+// the snapshot is released.
+type Snapshot struct {
+	store  *Store
+	keyDir KeyDir
+	files  datafile.FileDir
+	// at is the time the snapshot was taken, keys expiring after it are
+	// still seen.
+	at uint64
+
+	mu       sync.RWMutex
+	released bool
+}
+
+// Snapshot returns a view of the store as it is now. The key directory is
+// copied under the store lock, so taking a snapshot costs time in proportion
+// to the number of keys. The snapshot must be released once done with.
+func (s *Store) Snapshot() *Snapshot {
+	s.Lock()
+	defer s.Unlock()
+
+	at := now()
+	snap := &Snapshot{
+		store:  s,
+		keyDir: s.KeyDir.Clone(),
+		files:  make(datafile.FileDir),
+		at:     at,
+	}
+	var expired []string
+	snap.keyDir.Ascend("", func(key string, meta Meta) bool {
+		if meta.Expiry != 0 && meta.Expiry <= at {
+			expired = append(expired, key)
+			return true
+		}
+		snap.files[meta.FileId] = s.FileDir[meta.FileId]
+		return true
+	})
+	for _, key := range expired {
+		snap.keyDir.Delete(key)
+	}
+	s.hold(snap.files)
+	return snap
+}
+
+// Get returns the value key had when the snapshot was taken, or
+// ErrKeyNotFound.
+func (sn *Snapshot) Get(key string) ([]byte, error) {
+	return sn.get(key)
+}
+
+// Has reports whether key existed when the snapshot was taken.
+func (sn *Snapshot) Has(key string) bool {
+	_, ok := sn.keyDir.Get(key)
+	return ok
+}
+
+// Len returns the number of keys in the snapshot.
+func (sn *Snapshot) Len() int {
+	return sn.keyDir.Len()
+}
+
+// Iterator returns an iterator over the keys of the snapshot from start on
+// and before end, end being empty for no bound.
+func (sn *Snapshot) Iterator(start, end string) *Iterator {
+	return &Iterator{src: sn, next: start, end: end}
+}
+
+// Prefix returns an iterator over the keys of the snapshot starting with
+// prefix.
+func (sn *Snapshot) Prefix(prefix string) *Iterator {
+	return sn.Iterator(prefix, prefixEnd(prefix))
+}
+
+// Release drops the references the snapshot holds on datafiles. Merged
+// datafiles no snapshot refers to anymore are removed. Reads from a released
+// snapshot fail with ErrSnapshotReleased.
+func (sn *Snapshot) Release() {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	if sn.released {
+		return
+	}
+	sn.released = true
+
+	sn.store.release(sn.files)
+}
+
+// hold takes a reference on the datafiles so a merge does not remove them.
+// The caller must hold the store lock.
+func (s *Store) hold(files datafile.FileDir) {
+	for fileId := range files {
+		s.refs[fileId]++
+	}
+}
+
+// release drops the references taken by hold. Merged datafiles nothing refers
+// to anymore are removed.
+func (s *Store) release(files datafile.FileDir) {
+	s.Lock()
+	var retired datafile.FileDir
+	for fileId := range files {
+		s.refs[fileId]--
+		if s.refs[fileId] > 0 {
+			continue
+		}
+		delete(s.refs, fileId)
+		if df, ok := s.retired[fileId]; ok {
+			if retired == nil {
+				retired = make(datafile.FileDir)
+			}
+			retired[fileId] = df
+			delete(s.retired, fileId)
+		}
+	}
+	s.Unlock()
+
+	for fileId, df := range retired {
+		s.removeDatafile(fileId, df)
+	}
+}
+
+func (sn *Snapshot) get(key string) ([]byte, error) {
+	sn.mu.RLock()
+	defer sn.mu.RUnlock()
+	if sn.released {
+		return nil, ErrSnapshotReleased
+	}
+
+	meta, ok := sn.keyDir.Get(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	object, err := sn.files[meta.FileId].Read(meta.Offset, meta.ObjectSize)
+	if err != nil {
+		const msg = "failed to read data file"
+		sn.store.Log.Error(msg, zap.Error(err))
+		return nil, fmt.Errorf(msg+": %w", err)
+	}
+	record, err := sn.store.decodeObject(key, meta, object)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// keys returns the keys of the snapshot like Store.keys does for the store.
+func (sn *Snapshot) keys(from, end string, count int, match func(key string) bool) ([]string, string) {
+	var (
+		keys []string
+		next string
+		seen int
+	)
+	sn.keyDir.Ascend(from, func(key string, _ Meta) bool {
+		if end != "" && key >= end {
+			return false
+		}
+		if seen == count {
+			next = key
+			return false
+		}
+		seen++
+		if match == nil || match(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, next
+}
+
+// retire takes a merged datafile out of use. It is removed right away unless
+// a snapshot still refers to it, then it is kept until the last one is
+// released. It reports whether the datafile was kept. The caller must hold
+// the store lock.
+func (s *Store) retire(fileId int, df *datafile.Datafile) bool {
+	if s.refs[fileId] == 0 {
+		return false
+	}
+	s.retired[fileId] = df
+	return true
+}
+
+// removeDatafile closes a datafile that is out of use and removes it along
+// with its hint file.
+func (s *Store) removeDatafile(fileId int, df *datafile.Datafile) {
+	if err := df.Close(); err != nil {
+		const msg = "failed to close merged datafile"
+		s.Log.Error(msg, zap.Error(err), zap.Int("fileId", fileId))
+	}
+	for _, path := range []string{datafile.GetDatafile(s.dir(), fileId), GetHintFile(s.dir(), fileId)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			const msg = "failed to remove merged datafile"
+			s.Log.Error(msg, zap.Error(err), zap.String("path", path))
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+	"github.com/ajaxchavan/bytecask/internal/datafile"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	opts := []config.OptFunc{config.WithMaxDatafileSize(256), config.WithMergeDeadRatio(0.1)}
+	store := newTestStore(t, dir, opts...)
+
+	for i := 0; i < 20; i++ {
+		if err := store.set(fmt.Sprintf("key%02d", i), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.put("expiring", []byte("old"), now()+3600_000); err != nil {
+		t.Fatal(err)
+	}
+	snap := store.Snapshot()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if i%2 == 0 {
+			if _, err := store.del(key); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := store.set(key, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.set("added", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	store.hints.wait()
+
+	store.Lock()
+	merged := make([]int, 0, len(snap.files))
+	for fileId := range snap.files {
+		if fileId != store.FileId {
+			merged = append(merged, fileId)
+		}
+	}
+	store.Unlock()
+	store.compact(context.Background())
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key%02d", i)
+			if got, err := snap.Get(key); err != nil || string(got) != "old" {
+				t.Fatalf("snapshot get %s: got %q, %v", key, got, err)
+			}
+		}
+		if snap.Has("added") {
+			t.Fatal("snapshot sees a key added after it")
+		}
+		it := snap.Prefix("key")
+		n := 0
+		for it.Next() {
+			n++
+		}
+		if it.Err() != nil || n != 20 {
+			t.Fatalf("snapshot iterator: got %d keys, %v", n, it.Err())
+		}
+	}
+	check()
+
+	for _, fileId := range merged {
+		if _, ok := store.FileDir[fileId]; ok {
+			t.Fatalf("datafile %d was not merged", fileId)
+		}
+		if _, err := os.Stat(datafile.GetDatafile(store.dir(), fileId)); err != nil {
+			t.Fatalf("datafile %d was removed under the snapshot: %v", fileId, err)
+		}
+	}
+
+	// a crash before the snapshot is released leaves the merged datafiles
+	// behind, they must not bring deleted keys back
+	store.compact(context.Background())
+	check()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store = newTestStore(t, dir, opts...)
+	defer store.Close()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		got, err := store.get(key)
+		if i%2 == 0 && err != ErrKeyNotFound || i%2 == 1 && string(got) != "new" {
+			t.Fatalf("get %s after restart: got %q, %v", key, got, err)
+		}
+	}
+
+	snap = store.Snapshot()
+	for i := 0; i < 5; i++ {
+		store.compact(context.Background())
+	}
+	snap.Release()
+	if _, err := snap.Get("key01"); err != ErrSnapshotReleased {
+		t.Fatalf("get from a released snapshot: got %v", err)
+	}
+	store.Lock()
+	defer store.Unlock()
+	if len(store.retired) != 0 || len(store.refs) != 0 {
+		t.Fatalf("released snapshot left %d datafiles and %d references", len(store.retired), len(store.refs))
+	}
+	for fileId := range snap.files {
+		if _, ok := store.FileDir[fileId]; ok {
+			continue
+		}
+		if _, err := os.Stat(datafile.GetDatafile(store.dir(), fileId)); !os.IsNotExist(err) {
+			t.Fatalf("merged datafile %d is still there after the release", fileId)
+		}
+	}
+}
+
+func TestSnapshotHeldAcrossRestart(t *testing.T) {
+	for _, close := range []bool{false, true} {
+		t.Run(fmt.Sprintf("close=%v", close), func(t *testing.T) {
+			dir := t.TempDir()
+			opts := []config.OptFunc{config.WithMergeDeadRatio(0.1)}
+			store := newTestStore(t, dir, opts...)
+
+			rotate := func() {
+				store.Lock()
+				defer store.Unlock()
+				if err := store.updateActiveDatafile(store.FileId + 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the value and the tombstone hiding it end up in different
+			// datafiles, both merged
+			if err := store.set("gone", []byte("v1")); err != nil {
+				t.Fatal(err)
+			}
+			rotate()
+			snap := store.Snapshot()
+			if _, err := store.del("gone"); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 20; i++ {
+				if err := store.set("other", []byte(fmt.Sprintf("v%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rotate()
+			store.hints.wait()
+			store.compact(context.Background())
+			if got, err := snap.Get("gone"); err != nil || string(got) != "v1" {
+				t.Fatalf("snapshot get gone: got %q, %v", got, err)
+			}
+
+			// the snapshot is never released: a clean close removes the
+			// datafiles kept for it, a crash leaves them behind
+			if close {
+				store.Lock()
+				retired := make([]int, 0, len(store.retired))
+				for fileId := range store.retired {
+					retired = append(retired, fileId)
+				}
+				store.Unlock()
+				if len(retired) == 0 {
+					t.Fatal("no datafile was kept for the snapshot")
+				}
+				if err := store.Close(); err != nil {
+					t.Fatal(err)
+				}
+				for _, fileId := range retired {
+					if _, err := os.Stat(datafile.GetDatafile(dir, fileId)); !os.IsNotExist(err) {
+						t.Fatalf("datafile %d kept for the snapshot is still there after close", fileId)
+					}
+				}
+			} else {
+				store.Shutdown()
+			}
+
+			store = newTestStore(t, dir, opts...)
+			defer store.Close()
+			if got, err := store.get("gone"); err != ErrKeyNotFound {
+				t.Fatalf("get gone after restart: got %q, %v", got, err)
+			}
+			if got, err := store.get("other"); err != nil || string(got) != "v19" {
+				t.Fatalf("get other after restart: got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+// pausingContext calls fn the first time a merge checks whether it was
+// cancelled, which it does before copying every record.
+type pausingContext struct {
+	context.Context
+	once sync.Once
+	fn   func()
+}
+
+func (c *pausingContext) Err() error {
+	c.once.Do(c.fn)
+	return c.Context.Err()
+}
+
+func TestSnapshotDuringMerge(t *testing.T) {
+	dir := t.TempDir()
+	opts := []config.OptFunc{config.WithMergeDeadRatio(0.1)}
+	store := newTestStore(t, dir, opts...)
+	rotate := func() {
+		store.Lock()
+		defer store.Unlock()
+		if err := store.updateActiveDatafile(store.FileId + 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set := func(key, value string) {
+		if err := store.set(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the merge drops the tombstone of gone, nothing older than it is left
+	// out when the merge starts
+	set("gone", "v1")
+	set("kept", "v1")
+	rotate()
+	if _, err := store.del("gone"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		set("other", fmt.Sprintf("v%d", i))
+	}
+	rotate()
+	set("other", "v20")
+	store.hints.wait()
+
+	// a snapshot taken meanwhile keeps the value of gone on disk
+	var snap *Snapshot
+	ctx := &pausingContext{Context: context.Background(), fn: func() {
+		snap = store.Snapshot()
+		if _, err := store.del("kept"); err != nil {
+			t.Error(err)
+		}
+	}}
+	store.compact(ctx)
+	if snap == nil {
+		t.Fatal("merge did not run")
+	}
+	if got, err := snap.Get("kept"); err != nil || string(got) != "v1" {
+		t.Fatalf("snapshot get kept: got %q, %v", got, err)
+	}
+
+	// crash with the snapshot still held
+	store.Shutdown()
+	store = newTestStore(t, dir, opts...)
+	defer store.Close()
+	for _, key := range []string{"gone", "kept"} {
+		if got, err := store.get(key); err != ErrKeyNotFound {
+			t.Fatalf("get %s after restart: got %q, %v", key, got, err)
+		}
+	}
+	if got, err := store.get("other"); err != nil || string(got) != "v20" {
+		t.Fatalf("get other after restart: got %q, %v", got, err)
+	}
+}
@@ -1,43 +1,47 @@
 package core
 
 import (
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 
+	"github.com/ajaxchavan/bytecask/internal/config"
 	"github.com/ajaxchavan/bytecask/internal/datafile"
 )
 
 const (
-	hintFile          = "key_hint.db"
-	headerSize uint32 = 16
+	headerSize uint32 = 25
 	errLimit   uint32 = 5
+	// maxRecordSize is the size of the largest record a command writes, a
+	// key and a value of the largest bulk length. A crash tears at most the
+	// record being appended, a longer tail is damage that is not cut off at
+	// startup.
+	maxRecordSize = int64(headerSize) + 2*config.BulkLengthMax
 )
 
 var (
 	// fileRegex is the regex for a file.
 	// A valid file is in the format of: data_[0-9].db
-	fileRegex = regexp.MustCompile(`data_([0-9]+)\.db`)
+	fileRegex = regexp.MustCompile(`^data_([0-9]+)\.db$`)
 )
 
 // buildStale
 func (s *Store) buildFileDir() (int, error) {
 	var (
 		filePath   string
-		reader     *os.File
+		dt         *datafile.Datafile
 		number     int
 		fileId     int    = 0
 		err        error  = nil
 		errCounter uint32 = 0
 	)
 
-	data, err := ioutil.ReadDir(s.cfg.Dir)
+	data, err := ioutil.ReadDir(s.dir())
 	if err != nil {
 		const msg = "failed read data directory"
 		s.Log.Error(msg, zap.Error(err))
@@ -45,7 +49,8 @@ func (s *Store) buildFileDir() (int, error) {
 	}
 
 	for _, file := range data {
-		if file.Name() == hintFile {
+		// hint files, the lock file and leftovers of interrupted writes
+		if filepath.Ext(file.Name()) != ".db" || !file.Mode().IsRegular() {
 			continue
 		}
 
@@ -68,27 +73,23 @@ func (s *Store) buildFileDir() (int, error) {
 
 		errCounter = 0
 		for {
-			if file.Mode().IsRegular() {
-				filePath = filepath.Join(s.cfg.Dir, file.Name())
-				reader, err = os.Open(filePath)
-				if err != nil {
-					const msg = "failed to open file"
-					s.Log.Error(msg, zap.Error(err))
-					if errCounter >= errLimit {
-						break
-					}
-					errCounter += 1
-					continue
-				}
-
-				s.FileDir[number] = &datafile.Datafile{
-					Reader: reader,
+			filePath = filepath.Join(s.dir(), file.Name())
+			dt, err = datafile.Open(filePath)
+			if err != nil {
+				const msg = "failed to open file"
+				s.Log.Error(msg, zap.Error(err))
+				if errCounter >= errLimit {
+					break
 				}
-				break
+				errCounter += 1
+				continue
 			}
+
+			s.FileDir[number] = dt
+			break
 		}
 
-		if errCounter > errLimit {
+		if errCounter >= errLimit {
 			const msg = "failed creat a reader for file"
 			s.Log.Error(msg, zap.Error(err), zap.String("file", file.Name()))
 			return 0, fmt.Errorf(msg+": %w", err)
@@ -98,88 +99,154 @@ func (s *Store) buildFileDir() (int, error) {
 	return fileId, nil
 }
 
-func (s *Store) buildKeyDirWithHintFile() error {
-	fpath := filepath.Join(s.cfg.Dir, hintFile)
-	file, err := os.Open(fpath)
-	if err != nil {
-		const msg = "failed to open hint file"
-		s.Log.Error(msg, zap.Error(err))
-		return fmt.Errorf(msg+": %w", err)
-	}
+// buildKeyDir replays the datafiles from oldest to newest. A datafile is read
+// through its hint file when it has a valid one and scanned otherwise, in
+// which case the missing hint file is written for the next start, except for
+// the newest datafile which is about to be reused for writing.
+func (s *Store) buildKeyDir() error {
+	for fileId := 1; fileId <= s.FileId; fileId++ {
+		dt, ok := s.FileDir[fileId]
+		if !ok {
+			continue
+		}
 
-	encoder := gob.NewDecoder(file)
-	if err := encoder.Decode(&s.KeyDir); err != nil {
-		const msg = "failed to decode keydir"
-		s.Log.Error(msg, zap.Error(err))
-		return fmt.Errorf(msg+": %w", err)
+		entries, err := s.readHintFile(fileId, dt)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				const msg = "ignoring hint file"
+				s.Log.Warn(msg, zap.Error(err), zap.Int("fileId", fileId))
+			}
+
+			var end uint32
+			entries, end, err = s.scanHintEntries(dt)
+			if err != nil {
+				return fmt.Errorf("datafile %d: %w", fileId, err)
+			}
+
+			switch {
+			case int(end) < dt.Size():
+				const msg = "ignoring the invalid tail of datafile"
+				s.Log.Warn(msg, zap.Int("fileId", fileId), zap.Uint32("offset", end), zap.Int("size", dt.Size()))
+			case fileId < s.FileId && !s.cfg.ReadOnly:
+				if err := writeHintFile(GetHintFile(s.dir(), fileId), entries, end); err != nil {
+					const msg = "failed to write hint file"
+					s.Log.Error(msg, zap.Error(err), zap.Int("fileId", fileId))
+				}
+			}
+		}
+
+		for _, entry := range entries {
+			if entry.Type == recordTombstone || isExpired(entry.Expiry) {
+				s.deleteMeta(entry.Key)
+				s.tombstones[fileId] += int64(entry.ObjectSize)
+				continue
+			}
+			s.putMeta(entry.Key, Meta{
+				Timestamp:  entry.Timestamp,
+				Offset:     entry.Offset,
+				ObjectSize: entry.ObjectSize,
+				FileId:     fileId,
+				Expiry:     entry.Expiry,
+			})
+		}
 	}
 
 	return nil
 }
 
-func (s *Store) buildKeyDir() {
+// scanDatafile reads the records of dt in order, verifying each checksum, and
+// calls fn with the offset of each one. It stops at a record that is cut short
+// or fails its checksum at the very end of the file, which is what a crash in
+// the middle of an append leaves behind, and returns the offset that record
+// starts at. That is the end of the valid part of the file. A bad record with
+// more data after it is corruption rather than a torn write and is reported
+// as ErrCorruptRecord.
+//
+// The records of a batch are only passed to fn once its commit marker is
+// read. A batch still open at the end of the file was cut short by a crash,
+// the valid part of the file then ends where the batch begins.
+func (s *Store) scanDatafile(dt *datafile.Datafile, fn func(offset uint32, record *Record)) (uint32, error) {
 	var (
-		err        error  = nil
-		offset     uint32 = 0
-		headerObj  []byte
-		header     Header
-		object     []byte
-		objectSize uint32
-		errCounter uint32 = 0
-		key        string
+		offset uint32 = 0
+		size          = uint32(dt.Size())
+		header Header
+
+		batch      []scannedRecord
+		batchStart uint32
+		inBatch    bool
 	)
+	end := func(offset uint32) (uint32, error) {
+		if inBatch {
+			return batchStart, nil
+		}
+		return offset, nil
+	}
 
-	for fileId := 1; fileId <= s.FileId; fileId++ {
-		errCounter = 0
-		dt := s.FileDir[fileId]
-		offset = 0
-		for {
-			headerObj, err = dt.Read(offset, headerSize)
-			if err != nil {
-				if err == io.EOF || errCounter > errLimit {
-					break
-				}
-				s.Log.Error("failed to read datafile for header", zap.Error(err), zap.Uint32("error counter", errCounter))
-				errCounter += 1
-				continue
-			}
+	for offset+headerSize <= size {
+		headerObj, err := dt.Read(offset, headerSize)
+		if err != nil {
+			const msg = "failed to read datafile for header"
+			s.Log.Error(msg, zap.Error(err), zap.Uint32("offset", offset))
+			return offset, fmt.Errorf(msg+": %w", err)
+		}
 
-			if err = header.decode(headerObj); err != nil {
-				const msg = "failed to decode the header"
-				s.Log.Error(msg, zap.Error(err))
-				if errCounter > errLimit {
-					break
-				}
-				errCounter += 1
-				continue
-			}
+		if err := header.decode(headerObj); err != nil {
+			const msg = "failed to decode the header"
+			s.Log.Error(msg, zap.Error(err), zap.Uint32("offset", offset))
+			return offset, fmt.Errorf(msg+": %w", err)
+		}
 
-			if header.Timestamp == 0 {
-				offset += headerSize
-				continue
-			}
+		// a zeroed header is space the filesystem allocated but never wrote
+		if header.Timestamp == 0 {
+			return end(offset)
+		}
 
-			objectSize = headerSize + header.KeySize + header.ValSize
-			object, err = dt.Read(offset, objectSize)
-			if err != nil {
-				if err == io.EOF || errCounter > errLimit {
-					break
-				}
-				s.Log.Error("failed to read datafile for header", zap.Error(err), zap.Uint32("error counter", errCounter))
-				errCounter += 1
-				continue
-			}
+		objectSize := uint64(headerSize) + uint64(header.KeySize) + uint64(header.ValSize)
+		if uint64(offset)+objectSize > uint64(size) {
+			return end(offset)
+		}
+
+		object, err := dt.Read(offset, uint32(objectSize))
+		if err != nil {
+			const msg = "failed to read datafile for record"
+			s.Log.Error(msg, zap.Error(err), zap.Uint32("offset", offset))
+			return offset, fmt.Errorf(msg+": %w", err)
+		}
 
-			key = string(object[headerSize : headerSize+header.KeySize])
+		record, err := decodeRecord(object)
+		if err != nil {
+			if uint64(offset)+objectSize == uint64(size) {
+				return end(offset)
+			}
+			const msg = "found a corrupt record"
+			s.Log.Error(msg, zap.Error(err), zap.Uint32("offset", offset))
+			return offset, fmt.Errorf("%w at offset %d", err, offset)
+		}
 
-			s.KeyDir[key] = &Meta{
-				Timestamp:  header.Timestamp,
-				Offset:     offset,
-				ObjectSize: objectSize,
-				FileId:     fileId,
+		switch {
+		case record.Type == recordBatchBegin:
+			// a batch begun before without a commit marker is dropped
+			batch, batchStart, inBatch = batch[:0], offset, true
+		case record.Type == recordBatchCommit:
+			if inBatch && batchCount(record) == len(batch) && fn != nil {
+				for _, r := range batch {
+					fn(r.offset, r.record)
+				}
 			}
-			offset += objectSize
-			errCounter = 0
+			batch, inBatch = batch[:0], false
+		case inBatch:
+			batch = append(batch, scannedRecord{offset: offset, record: record})
+		case fn != nil:
+			fn(offset, record)
 		}
+		offset += uint32(objectSize)
 	}
+
+	return end(offset)
+}
+
+// scannedRecord is a record of a batch held back until the batch commits.
+type scannedRecord struct {
+	offset uint32
+	record *Record
 }
@@ -2,12 +2,15 @@ package core
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
-	"hash/crc32"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ajaxchavan/bytecask/internal/config"
@@ -15,46 +18,144 @@ import (
 	"github.com/ajaxchavan/bytecask/internal/log"
 )
 
-var (
-	RESP_OK           = []byte("OK")
-	RESP_NIL          = []byte("(nil)")
-	RESP_INTERNAL_ERR = []byte("internal_error")
-	RESP_ONE          = []byte("1")
-	RESP_ZERO         = []byte("0")
-)
-
 type Store struct {
-	dataFile   *datafile.Datafile
-	KeyDir     KeyDir
-	FileDir    datafile.FileDir
+	dataFile *datafile.Datafile
+	// KeyDir is sharded, readers look keys up without the store lock.
+	KeyDir  KeyDir
+	FileDir datafile.FileDir
+	// files is a copy of FileDir for readers, replaced whenever FileDir
+	// changes.
+	files      atomic.Pointer[datafile.FileDir]
 	BufferPool sync.Pool
 	FileId     int
 	Log        log.Log
 	cfg        config.Config
+	// hints tracks hint files being written for sealed datafiles, they are
+	// not merged until it is done.
+	hints *hintWriters
+	// live holds the number of bytes in each datafile the key directory
+	// points at, the rest of a datafile is dead and reclaimed by a merge.
+	live map[int]int64
+	// tombstones holds the number of bytes of tombstones in each datafile.
+	// They are kept until the values they hide are gone.
+	tombstones map[int]int64
+	// version is the last version given to a key directory entry.
+	version uint64
+	// refs holds the number of snapshots referring to each datafile.
+	refs map[int]int
+	// retired holds the merged datafiles kept on disk for snapshots.
+	retired datafile.FileDir
+	// appends counts the appends to the active datafile.
+	appends uint64
+	// unsynced counts the bytes appended to the active datafile since it was
+	// last synced under the store lock.
+	unsynced int64
+	// group lets writers share syncs.
+	group *groupCommit
+	// backup tracks the checkpoints BACKUP writes in the background.
+	backup backupState
+	// lock holds the directory lock, it is nil for a read-only store.
+	lock *os.File
 	sync.Mutex
 }
 
-func createDirectory(directory string) error {
-	if err := os.Mkdir(directory, os.ModePerm); err != nil && !os.IsExist(err) {
-		return err
+// datafile returns the datafile identified by fileId, or nil when there is
+// none. It does not take the store lock.
+func (s *Store) datafile(fileId int) *datafile.Datafile {
+	if files := s.files.Load(); files != nil {
+		return (*files)[fileId]
 	}
 	return nil
 }
 
-func New(cfg config.Config, logger log.Log, hint bool) (*Store, error) {
+// publishFiles hands readers a copy of FileDir. A datafile must be published
+// before the key directory points into it. The caller must hold the store
+// lock.
+func (s *Store) publishFiles() {
+	files := maps.Clone(s.FileDir)
+	s.files.Store(&files)
+}
+
+// dir returns the path of the data directory.
+func (s *Store) dir() string {
+	return filepath.Join(s.cfg.Path, s.cfg.Dir)
+}
+
+func createDirectory(directory string) error {
+	return os.MkdirAll(directory, os.ModePerm)
+}
+
+func New(cfg config.Config, logger log.Log) (*Store, error) {
+	if cfg.MaxDatafileSize <= 0 || cfg.MaxDatafileSize > math.MaxUint32 {
+		return nil, fmt.Errorf("max datafile size must be between 1 and %d bytes", uint32(math.MaxUint32))
+	}
+
 	wd := filepath.Join(cfg.Path, cfg.Dir)
 
-	err := createDirectory(wd)
-	var number int
+	var lock *os.File
+	if !cfg.ReadOnly {
+		if err := createDirectory(wd); err != nil {
+			const msg = "failed to create data directory"
+			logger.Error(msg, zap.Error(err))
+			return nil, fmt.Errorf(msg+": %w", err)
+		}
 
-	store := Store{
-		Log:     logger,
-		cfg:     cfg,
-		KeyDir:  make(map[string]*Meta),
-		FileDir: make(map[int]*datafile.Datafile),
+		var err error
+		lock, err = lockDirectory(wd)
+		if err != nil {
+			const msg = "failed to lock data directory"
+			logger.Error(msg, zap.Error(err))
+			return nil, fmt.Errorf(msg+": %w", err)
+		}
+
+		if err := removeTempFiles(wd); err != nil {
+			_ = unlockDirectory(lock)
+			const msg = "failed to remove temporary files"
+			logger.Error(msg, zap.Error(err))
+			return nil, fmt.Errorf(msg+": %w", err)
+		}
+	}
+
+	store, err := open(cfg, logger)
+	if err != nil {
+		if lock != nil {
+			_ = unlockDirectory(lock)
+		}
+		return nil, err
+	}
+	store.lock = lock
+
+	return store, nil
+}
+
+// newStore returns a store for cfg with nothing loaded yet.
+func newStore(cfg config.Config, logger log.Log) *Store {
+	return &Store{
+		BufferPool: sync.Pool{
+			New: func() interface{} {
+				return new(bytes.Buffer)
+			},
+		},
+		Log:        logger,
+		cfg:        cfg,
+		KeyDir:     newShardedKeyDir(cfg.KeyDirShards, cfg.CompactKeyDir),
+		FileDir:    make(map[int]*datafile.Datafile),
+		hints:      newHintWriters(),
+		live:       make(map[int]int64),
+		tombstones: make(map[int]int64),
+		refs:       make(map[int]int),
+		retired:    make(datafile.FileDir),
+		group:      newGroupCommit(cfg),
 	}
+}
+
+// open loads the data directory once it is safe to do so.
+func open(cfg config.Config, logger log.Log) (*Store, error) {
+	var number int
+
+	store := newStore(cfg, logger)
 
-	number, err = store.buildFileDir()
+	number, err := store.buildFileDir()
 	if err != nil {
 		const msg = "failed to build file directory"
 		logger.Error(msg, zap.Error(err))
@@ -62,135 +163,371 @@ func New(cfg config.Config, logger log.Log, hint bool) (*Store, error) {
 	}
 	store.FileId = number
 
-	if hint {
-		if err := store.buildKeyDirWithHintFile(); err != nil {
-			const msg = "failed to build key directory"
+	if err := store.buildKeyDir(); err != nil {
+		const msg = "failed to build key directory"
+		logger.Error(msg, zap.Error(err))
+		return nil, fmt.Errorf(msg+": %w", err)
+	}
+
+	if !cfg.ReadOnly {
+		store.dataFile, store.FileId, err = store.openActiveDatafile(number)
+		if err != nil {
+			const msg = "failed to open active datafile"
 			logger.Error(msg, zap.Error(err))
 			return nil, fmt.Errorf(msg+": %w", err)
 		}
-	} else {
-		store.buildKeyDir()
 	}
+	for fileId, df := range store.FileDir {
+		if df != store.dataFile {
+			store.mapDatafile(fileId, df)
+		}
+	}
+	store.publishFiles()
 
-	number += 1
+	// debug
+	logger.Info("info", zap.Int("number", store.FileId))
+	return store, nil
+}
+
+// openActiveDatafile opens the datafile new writes are appended to. The
+// newest datafile is reused when it still has room. A crash while appending
+// can leave a partial record at its end, which is cut off first so the offset
+// of the next write lines up with the last complete record.
+func (s *Store) openActiveDatafile(lastId int) (*datafile.Datafile, int, error) {
+	if lastId > 0 {
+		df, err := datafile.New(datafile.GetDatafile(s.dir(), lastId))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		end, err := s.scanDatafile(df, nil)
+		if err != nil {
+			df.Close()
+			return nil, 0, err
+		}
+		if torn := int64(df.Size()) - int64(end); torn > maxRecordSize {
+			df.Close()
+			const msg = "datafile has more than a torn record after its last valid one"
+			s.Log.Error(msg, zap.Int("fileId", lastId), zap.Uint32("offset", end), zap.Int("size", df.Size()))
+			return nil, 0, fmt.Errorf("%w: datafile %d has %d bytes past offset %d, more than a torn record; run repair to drop them", ErrCorruptRecord, lastId, torn, end)
+		}
+		if int(end) < df.Size() {
+			const msg = "truncating torn tail of datafile"
+			s.Log.Warn(msg, zap.Int("fileId", lastId), zap.Uint32("offset", end), zap.Int("size", df.Size()))
+			if err := df.Truncate(int(end)); err != nil {
+				df.Close()
+				return nil, 0, err
+			}
+		}
 
-	df, err := datafile.New(filepath.Join(wd, fmt.Sprintf("data_%v.db", number)))
+		if old, ok := s.FileDir[lastId]; ok {
+			_ = old.Close()
+		}
+		s.FileDir[lastId] = df
+
+		if !df.IsFull(s.cfg.MaxDatafileSize, 1) {
+			return df, lastId, nil
+		}
+		if err := s.sealDatafile(lastId, df); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	df, err := datafile.New(datafile.GetDatafile(s.dir(), lastId+1))
 	if err != nil {
-		const msg = "failed to create datafile"
-		logger.Error(msg, zap.Error(err))
-		return nil, fmt.Errorf(msg+": %w", err)
+		return nil, 0, err
 	}
+	s.FileDir[lastId+1] = df
+
+	return df, lastId + 1, nil
+}
 
-	store.FileDir[number] = df
+// Get returns the value stored for key, or ErrKeyNotFound.
+func (s *Store) Get(key string) ([]byte, error) {
+	return s.get(key)
+}
 
-	// debug
-	logger.Info("info", zap.Int("number", number))
-	return &Store{
-		dataFile: df,
-		BufferPool: sync.Pool{
-			New: func() interface{} {
-				return new(bytes.Buffer)
-			},
-		},
-		KeyDir:  store.KeyDir,
-		FileDir: store.FileDir,
-		FileId:  number,
-		Log:     logger,
-		cfg:     cfg,
-	}, nil
+// Put stores value for key.
+func (s *Store) Put(key string, value []byte) error {
+	return s.set(key, value)
 }
 
-func (s *Store) get(key string) []byte {
+// Has reports whether key exists.
+func (s *Store) Has(key string) bool {
+	_, ok := s.peek(key)
+	return ok
+}
+
+// Delete removes key and reports whether it existed.
+func (s *Store) Delete(key string) (bool, error) {
+	return s.del(key)
+}
+
+// Sync returns once every write acknowledged so far is on disk. Concurrent
+// calls share a sync.
+func (s *Store) Sync() error {
+	if s.cfg.ReadOnly {
+		return nil
+	}
+
+	return s.WaitSynced(s.appendCount())
+}
+
+// appendCount returns the count of appends to the active datafile so far.
+func (s *Store) appendCount() uint64 {
 	s.Lock()
-	meta := s.KeyDir[key]
-	if meta == nil {
-		s.Unlock()
-		return RESP_NIL
+	defer s.Unlock()
+	return s.appends
+}
+
+// Close shuts the store down and closes every datafile, removing the merged
+// ones still kept for snapshots. The store must not be used afterwards.
+func (s *Store) Close() error {
+	s.Shutdown()
+
+	s.Lock()
+	defer s.Unlock()
+	var errs []error
+	for _, df := range s.FileDir {
+		errs = append(errs, df.Close())
 	}
-	dataFile := s.FileDir[meta.FileId]
-	s.Unlock()
+	// no snapshot outlives the store, the datafiles kept for them can go
+	for fileId, df := range s.retired {
+		s.removeDatafile(fileId, df)
+	}
+	s.retired = make(datafile.FileDir)
+	return errors.Join(errs...)
+}
 
-	// TODO(edge_case): we got the datafile and at the same time compaction deleted that datafile.
-	object, err := dataFile.Read(meta.Offset, meta.ObjectSize)
+func (s *Store) get(key string) ([]byte, error) {
+	record, err := s.read(key)
+	if err != nil {
+		return nil, err
+	}
+	return record.Value, nil
+}
+
+// View calls fn with the value stored for key, or returns ErrKeyNotFound.
+// With mapped reads the value is not copied out of the datafile: fn must
+// neither change it nor keep it after it returns.
+func (s *Store) View(key string, fn func(value []byte) error) error {
+	return s.visit(key, true, func(record *Record) error {
+		return fn(record.Value)
+	})
+}
+
+// read returns the record key points at, or ErrKeyNotFound. It does not take
+// the store lock.
+func (s *Store) read(key string) (*Record, error) {
+	var record *Record
+	err := s.visit(key, false, func(r *Record) error {
+		record = r
+		return nil
+	})
+	return record, err
+}
+
+// visit calls fn with the record key points at, or returns ErrKeyNotFound.
+// With view set the record may be a view of a mapped datafile, which is only
+// valid until fn returns; otherwise it is a copy of its own.
+func (s *Store) visit(key string, view bool, fn func(record *Record) error) error {
+	meta, ok := s.peek(key)
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	decoded := false
+	decode := func(object []byte) error {
+		decoded = true
+		record, err := s.decodeObject(key, meta, object)
+		if err != nil {
+			return err
+		}
+		if record.Type == recordTombstone {
+			return ErrKeyNotFound
+		}
+		return fn(record)
+	}
+
+	err := os.ErrClosed
+	if dataFile := s.datafile(meta.FileId); dataFile != nil {
+		if view {
+			err = dataFile.View(meta.Offset, meta.ObjectSize, decode)
+		} else {
+			var object []byte
+			if object, err = dataFile.Read(meta.Offset, meta.ObjectSize); err == nil {
+				err = decode(object)
+			}
+		}
+	}
+	if decoded {
+		return err
+	}
+	if errors.Is(err, os.ErrClosed) {
+		// a merge moved the key and closed the datafile after the lookup
+		if current, _ := s.KeyDir.Get(key); current != meta {
+			return s.visit(key, view, fn)
+		}
+	}
 	if err != nil {
 		const msg = "failed to read data file"
 		s.Log.Error(msg, zap.Error(err))
-		return RESP_INTERNAL_ERR
+		return fmt.Errorf(msg+": %w", err)
 	}
+	return nil
+}
 
-	header := Header{}
-	if err := header.decode(object); err != nil {
+// decodeObject decodes the object read for key at meta.
+func (s *Store) decodeObject(key string, meta Meta, object []byte) (*Record, error) {
+	record, err := decodeRecord(object)
+	if err == nil && record.Key != key {
+		err = ErrCorruptRecord
+	}
+	if err != nil {
 		const msg = "failed to decode the record"
-		s.Log.Error(msg, zap.Error(err))
-		return RESP_INTERNAL_ERR
+		s.Log.Error(msg, zap.Error(err), zap.Int("fileId", meta.FileId), zap.Uint32("offset", meta.Offset))
+		return nil, fmt.Errorf(msg+": %w", err)
 	}
+	return record, nil
+}
 
-	if header.ValSize == 0 {
-		return RESP_NIL
+func (s *Store) set(key string, value []byte) error {
+	return s.put(key, value, 0)
+}
+
+// put stores value for key. The key expires at expiry unless it is zero.
+func (s *Store) put(key string, value []byte, expiry uint64) error {
+	_, err := s.write(newRecord(key, value, recordValue, expiry))
+	return err
+}
+
+// del writes a tombstone for key and reports whether the key existed.
+func (s *Store) del(key string) (bool, error) {
+	if _, ok := s.peek(key); !ok {
+		return false, nil
 	}
 
-	return object[meta.ObjectSize-header.ValSize:]
+	return s.write(newRecord(key, nil, recordTombstone, 0))
 }
 
-func (s *Store) set(key string, value []byte) []byte {
-	header := Header{
-		Timestamp: uint32(time.Now().Unix()),
-		Crc:       crc32.ChecksumIEEE(value),
-		KeySize:   uint32(len(key)),
-		ValSize:   uint32(len(value)),
+func newRecord(key string, value []byte, typ recordType, expiry uint64) *Record {
+	return &Record{
+		Header: Header{
+			Timestamp: uint32(time.Now().Unix()),
+			Expiry:    expiry,
+			KeySize:   uint32(len(key)),
+			ValSize:   uint32(len(value)),
+			Type:      typ,
+		},
+		Key:   key,
+		Value: value,
 	}
+}
+
+// write appends record to the active datafile and reports whether its key
+// existed before.
+func (s *Store) write(record *Record) (bool, error) {
+	existed, seq, err := s.writeRecord(record)
+	if err != nil {
+		return false, err
+	}
+	return existed, s.waitDurable(seq)
+}
+
+// writeRecord appends record like write without waiting for a sync. It also
+// returns the count of appends the record is part of.
+func (s *Store) writeRecord(record *Record) (bool, uint64, error) {
+	if s.cfg.ReadOnly {
+		return false, 0, ErrReadOnly
+	}
+
 	buffer := s.BufferPool.Get().(*bytes.Buffer)
 	defer s.BufferPool.Put(buffer)
 	defer buffer.Reset()
 
-	if err := header.encode(buffer); err != nil {
+	if err := record.encode(buffer); err != nil {
 		const msg = "unable to encode record"
 		s.Log.Error(msg, zap.Error(err))
-		return RESP_INTERNAL_ERR
+		return false, 0, fmt.Errorf(msg+": %w", err)
 	}
 
-	buffer.WriteString(key)
-	buffer.Write(value)
-
 	s.Lock()
-	offset, err := s.dataFile.Append(buffer.Bytes())
+	existed, err := s.appendRecord(record, buffer.Bytes())
+	seq := s.appends
+	s.Unlock()
+	return existed, seq, err
+}
+
+// appendRecord appends the encoded object of record to the active datafile
+// and points the key directory at it. It reports whether the key existed
+// before. A sync the sync mode asked for that failed is returned, the record
+// is indexed all the same. The caller must hold the store lock.
+func (s *Store) appendRecord(record *Record, object []byte) (bool, error) {
+	if s.dataFile.IsFull(s.cfg.MaxDatafileSize, len(object)) {
+		if err := s.updateActiveDatafile(s.FileId + 1); err != nil {
+			return false, err
+		}
+	}
+
+	offset, err := s.dataFile.Append(object)
 	if err != nil {
-		s.Unlock()
 		const msg = "unable to append record"
 		s.Log.Error(msg, zap.Error(err))
-		return RESP_INTERNAL_ERR
-	}
-	
-	if s.cfg.Fsync {
-		_ = s.dataFile.Flush()
-	}
-
-	s.KeyDir[key] = &Meta{
-		Timestamp:  header.Timestamp,
-		Offset:     uint32(offset),
-		ObjectSize: uint32(buffer.Len()),
-		FileId:     s.FileId,
+		return false, fmt.Errorf(msg+": %w", err)
 	}
-	s.Unlock()
+	err = s.appended(len(object))
 
-	return RESP_OK
+	return s.indexRecord(record, uint32(offset), uint32(len(object))), err
 }
 
-func (s *Store) del(key string) []byte {
-	object := string(s.get(key))
-	switch object {
-	case string(RESP_NIL):
-		return RESP_ZERO
-	case string(RESP_INTERNAL_ERR):
-		return RESP_INTERNAL_ERR
+// appended counts an append of n bytes to the active datafile and syncs it if
+// the sync mode asks for it now. A failed sync is returned, the append stays
+// and is indexed all the same, but must not be acknowledged as durable. The
+// caller must hold the store lock.
+func (s *Store) appended(n int) error {
+	s.appends++
+	s.unsynced += int64(n)
+	switch s.cfg.Sync {
+	case config.SyncEveryWrite:
+		if s.cfg.GroupCommit {
+			return nil
+		}
+	case config.SyncEveryBytes:
+		if s.unsynced < s.cfg.SyncBytes {
+			return nil
+		}
+	default:
+		return nil
 	}
 
-	resp := s.set(key, nil)
-	if string(resp) != string(RESP_OK) {
-		return RESP_INTERNAL_ERR
+	if err := s.dataFile.Flush(); err != nil {
+		const msg = "unable to sync active datafile"
+		s.Log.Error(msg, zap.Error(err))
+		return fmt.Errorf(msg+": %w", err)
 	}
+	s.unsynced = 0
+	s.group.markSynced(s.appends)
+	return nil
+}
 
-	return RESP_ONE
+// indexRecord points the key directory at record, written to the active
+// datafile at offset, and reports whether its key existed before. The caller
+// must hold the store lock.
+func (s *Store) indexRecord(record *Record, offset, size uint32) bool {
+	_, existed := s.lookup(record.Key)
+	if record.Type == recordTombstone {
+		s.deleteMeta(record.Key)
+		s.tombstones[s.FileId] += int64(size)
+		return existed
+	}
+	s.putMeta(record.Key, Meta{
+		Timestamp:  record.Timestamp,
+		Offset:     offset,
+		ObjectSize: size,
+		FileId:     s.FileId,
+		Expiry:     record.Expiry,
+	})
+	return existed
 }
 
 func (s *Store) isValidOffset(offset int) bool {
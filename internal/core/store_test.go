@@ -0,0 +1,483 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+	"github.com/ajaxchavan/bytecask/internal/datafile"
+	"github.com/ajaxchavan/bytecask/internal/log"
+)
+
+func newTestStore(t testing.TB, dir string, opts ...config.OptFunc) *Store {
+	t.Helper()
+
+	opts = append([]config.OptFunc{config.WithDirectoryPath(dir)}, opts...)
+	store, err := New(*config.NewConfig(opts...), log.Log{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	return store
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir)
+	r := rand.New(rand.NewSource(1))
+
+	want := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		key := string(randomBytes(r, 1+r.Intn(64)))
+		value := randomBytes(r, 1+r.Intn(4096))
+		// make sure the bytes that used to break the inline protocol show up
+		value[0] = "\x00\r\n"[i%3]
+		want[key] = value
+
+		if err := store.set(key, value); err != nil {
+			t.Fatalf("failed to set key: %v", err)
+		}
+	}
+
+	check := func(store *Store) {
+		for key, value := range want {
+			got, err := store.get(key)
+			if err != nil {
+				t.Fatalf("failed to get key %q: %v", key, err)
+			}
+			if !bytes.Equal(got, value) {
+				t.Fatalf("value mismatch for key %q", key)
+			}
+		}
+	}
+
+	check(store)
+	store.Shutdown()
+
+	// the values must survive being read back from the datafiles
+	check(newTestStore(t, dir))
+}
+
+func TestBinaryRoundTripOverProtocol(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+	r := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 100; i++ {
+		key := randomBytes(r, 1+r.Intn(32))
+		value := randomBytes(r, 1+r.Intn(8192))
+
+		var req bytes.Buffer
+		req.WriteString(fmt.Sprintf("*3\r\n$3\r\nSET\r\n$%d\r\n", len(key)))
+		req.Write(key)
+		req.WriteString(fmt.Sprintf("\r\n$%d\r\n", len(value)))
+		req.Write(value)
+		req.WriteString(fmt.Sprintf("\r\n*2\r\n$3\r\nGET\r\n$%d\r\n", len(key)))
+		req.Write(key)
+		req.WriteString("\r\n")
+
+		rp, _ := NewParser(&conn{Buffer: &req})
+		for _, want := range [][]byte{RESP_OK, Encode(value, false)} {
+			args, err := rp.Decode()
+			if err != nil {
+				t.Fatalf("failed to decode command: %v", err)
+			}
+			if got := store.executeCmd(NewCmd(args)); !bytes.Equal(got, want) {
+				t.Fatalf("expected %q, got %q", want, got)
+			}
+		}
+	}
+}
+
+func TestEvalAndResponseOrder(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	var cmds []*Cmd
+	var want bytes.Buffer
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i%10))
+		value := []byte(fmt.Sprintf("value_%d", i))
+		cmds = append(cmds, NewCmd([][]byte{[]byte("SET"), key, value}), NewCmd([][]byte{[]byte("GET"), key}))
+		want.Write(RESP_OK)
+		want.Write(Encode(value, false))
+	}
+
+	var got bytes.Buffer
+	store.EvalAndResponse(cmds, &got)
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("replies are out of order")
+	}
+}
+
+func TestDatafileRotation(t *testing.T) {
+	const maxSize = 1024
+	dir := t.TempDir()
+	store := newTestStore(t, dir, config.WithMaxDatafileSize(maxSize))
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 100; i++ {
+		if err := store.set(fmt.Sprintf("key_%03d", i), value); err != nil {
+			t.Fatalf("failed to set key: %v", err)
+		}
+	}
+
+	if store.FileId < 10 {
+		t.Fatalf("expected writes to rotate through several datafiles, active is %d", store.FileId)
+	}
+	for id, df := range store.FileDir {
+		if df.Size() > maxSize {
+			t.Errorf("datafile %d grew to %d bytes, limit is %d", id, df.Size(), maxSize)
+		}
+	}
+
+	store.Shutdown()
+	store = newTestStore(t, dir, config.WithMaxDatafileSize(maxSize))
+	for i := 0; i < 100; i++ {
+		got, err := store.get(fmt.Sprintf("key_%03d", i))
+		if err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("failed to read key_%03d back: %v", i, err)
+		}
+	}
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir)
+	for i := 0; i < 10; i++ {
+		if err := store.set(fmt.Sprintf("key_%d", i), []byte(fmt.Sprintf("value_%d", i))); err != nil {
+			t.Fatalf("failed to set key: %v", err)
+		}
+	}
+	store.Shutdown()
+	fileId, size := store.FileId, store.dataFile.Size()
+
+	// simulate a crash half way through appending a record
+	path := datafile.GetDatafile(filepath.Join(dir, ".data"), fileId)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("failed to open datafile: %v", err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0}); err != nil {
+		t.Fatalf("failed to write torn record: %v", err)
+	}
+	f.Close()
+
+	store = newTestStore(t, dir)
+	if store.FileId != fileId {
+		t.Fatalf("expected datafile %d to be reused, got %d", fileId, store.FileId)
+	}
+	if store.dataFile.Size() != size {
+		t.Fatalf("expected the torn tail to be cut back to %d bytes, got %d", size, store.dataFile.Size())
+	}
+
+	if err := store.set("after", []byte("crash")); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+	store.Shutdown()
+
+	store = newTestStore(t, dir)
+	for i := 0; i < 10; i++ {
+		got, err := store.get(fmt.Sprintf("key_%d", i))
+		if err != nil || string(got) != fmt.Sprintf("value_%d", i) {
+			t.Fatalf("failed to read key_%d back: %v", i, err)
+		}
+	}
+	if got, err := store.get("after"); err != nil || string(got) != "crash" {
+		t.Fatalf("failed to read the key written after recovery: %v", err)
+	}
+	store.Shutdown()
+
+	// more than a record past the last valid one is damage, not a torn
+	// append, and is left for repair
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()+maxRecordSize+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(store.cfg, store.Log); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("expected reopening to fail with %v, got %v", ErrCorruptRecord, err)
+	}
+	if got, err := os.Stat(path); err != nil || got.Size() != info.Size()+maxRecordSize+1 {
+		t.Fatalf("the datafile was truncated: %v", err)
+	}
+}
+
+func TestUnknownDatafileFormat(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, ".data")
+	if err := os.MkdirAll(data, 0777); err != nil {
+		t.Fatal(err)
+	}
+	// a datafile written before datafiles had a header
+	old := []byte("\x12\x34\x56\x78\x65\x00\x00\x00\x00\x00\x00\x03\x00\x00\x00\x05keyvalue")
+	path := datafile.GetDatafile(data, 1)
+	if err := os.WriteFile(path, old, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := []config.OptFunc{config.WithDirectoryPath(dir)}
+	if _, err := New(*config.NewConfig(opts...), log.Log{Logger: zap.NewNop()}); !errors.Is(err, datafile.ErrUnknownFormat) {
+		t.Fatalf("got %v, want %v", err, datafile.ErrUnknownFormat)
+	}
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, old) {
+		t.Fatalf("the refused datafile changed to %q, %v", got, err)
+	}
+}
+
+func TestHintFiles(t *testing.T) {
+	const maxSize = 512
+	dir := t.TempDir()
+	store := newTestStore(t, dir, config.WithMaxDatafileSize(maxSize))
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%d", i%30)
+		if err := store.set(key, []byte(fmt.Sprintf("value_%d", i))); err != nil {
+			t.Fatalf("failed to set key: %v", err)
+		}
+		if i%7 == 0 {
+			if _, err := store.del(key); err != nil {
+				t.Fatalf("failed to delete key: %v", err)
+			}
+		}
+	}
+	store.Shutdown()
+
+	dataDir := filepath.Join(dir, ".data")
+	for fileId := 1; fileId < store.FileId; fileId++ {
+		if _, err := os.Stat(GetHintFile(dataDir, fileId)); err != nil {
+			t.Fatalf("expected a hint file for sealed datafile %d: %v", fileId, err)
+		}
+	}
+
+	open := func() map[string]Meta {
+		store := newTestStore(t, dir, config.WithMaxDatafileSize(maxSize))
+		defer store.Shutdown()
+		keyDir := make(map[string]Meta)
+		store.KeyDir.Ascend("", func(key string, meta Meta) bool {
+			keyDir[key] = meta
+			return true
+		})
+		return keyDir
+	}
+	withHints := open()
+
+	// a hint file that does not match its datafile is ignored
+	if err := os.Truncate(GetHintFile(dataDir, 1), 10); err != nil {
+		t.Fatalf("failed to truncate hint file: %v", err)
+	}
+	if got := open(); !reflect.DeepEqual(got, withHints) {
+		t.Fatalf("keydir rebuilt around a corrupt hint file differs")
+	}
+
+	hints, _ := filepath.Glob(filepath.Join(dataDir, "*.hint"))
+	for _, hint := range hints {
+		os.Remove(hint)
+	}
+	if got := open(); !reflect.DeepEqual(got, withHints) {
+		t.Fatalf("keydir built from hint files differs from the one built by scanning")
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	for name, at := range map[string]func(meta Meta) int64{
+		"header": func(meta Meta) int64 { return datafile.HeaderSize + int64(meta.Offset) + crcSize + 1 },
+		"key":    func(meta Meta) int64 { return datafile.HeaderSize + int64(meta.Offset+headerSize) },
+		"value":  func(meta Meta) int64 { return datafile.HeaderSize + int64(meta.Offset+meta.ObjectSize) - 1 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := newTestStore(t, dir)
+			for _, key := range []string{"a", "b", "c"} {
+				if err := store.set(key, []byte("value_"+key)); err != nil {
+					t.Fatalf("failed to set key: %v", err)
+				}
+			}
+			store.Shutdown()
+
+			// flip a bit of the record in the middle of the datafile
+			meta, _ := store.KeyDir.Get("b")
+			f, err := os.OpenFile(datafile.GetDatafile(filepath.Join(dir, ".data"), meta.FileId), os.O_RDWR, 0666)
+			if err != nil {
+				t.Fatalf("failed to open datafile: %v", err)
+			}
+			b := make([]byte, 1)
+			if _, err := f.ReadAt(b, at(meta)); err != nil {
+				t.Fatalf("failed to read datafile: %v", err)
+			}
+			b[0] ^= 0x01
+			if _, err := f.WriteAt(b, at(meta)); err != nil {
+				t.Fatalf("failed to write datafile: %v", err)
+			}
+			f.Close()
+
+			if _, err := store.get("b"); !errors.Is(err, ErrCorruptRecord) {
+				t.Errorf("expected %v, got %v", ErrCorruptRecord, err)
+			}
+			if got := store.executeCmd(NewCmd([][]byte{[]byte("GET"), []byte("b")})); got[0] != '-' {
+				t.Errorf("expected an error reply, got %q", got)
+			}
+			if _, err := store.get("a"); err != nil {
+				t.Errorf("expected the other records to stay readable, got %v", err)
+			}
+
+			_, err = New(store.cfg, store.Log)
+			if !errors.Is(err, ErrCorruptRecord) {
+				t.Errorf("expected reopening to fail with %v, got %v", ErrCorruptRecord, err)
+			}
+		})
+	}
+}
+
+func TestDirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir)
+	if err := store.set("foo", []byte("bar")); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+
+	if _, err := New(store.cfg, store.Log); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected %v, got %v", ErrLocked, err)
+	}
+
+	// a read-only store shares the directory with the writer
+	reader := newTestStore(t, dir, config.WithReadOnly(true))
+	if got, err := reader.get("foo"); err != nil || string(got) != "bar" {
+		t.Fatalf("failed to read key from read-only store: %v", err)
+	}
+	if err := reader.set("foo", []byte("baz")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+	reader.Shutdown()
+
+	store.Shutdown()
+	newTestStore(t, dir).Shutdown()
+}
+
+func TestDelete(t *testing.T) {
+	store := newTestStore(t, t.TempDir())
+
+	if err := store.set("foo", []byte("bar")); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+
+	for _, want := range []bool{true, false} {
+		deleted, err := store.del("foo")
+		if err != nil {
+			t.Fatalf("failed to delete key: %v", err)
+		}
+		if deleted != want {
+			t.Errorf("expected deleted to be %v, got %v", want, deleted)
+		}
+	}
+
+	if _, err := store.get("foo"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir)
+
+	// an empty value is a value, not a deletion
+	if err := store.set("empty", []byte{}); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+	if err := store.set("deleted", []byte("value")); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+	if _, err := store.del("deleted"); err != nil {
+		t.Fatalf("failed to delete key: %v", err)
+	}
+	store.Close()
+
+	store = newTestStore(t, dir)
+	defer store.Close()
+	if got, err := store.get("empty"); err != nil || len(got) != 0 {
+		t.Fatalf("expected an empty value, got %q, %v", got, err)
+	}
+	if _, ok := store.KeyDir.Get("deleted"); ok {
+		t.Fatalf("deleted key is in the key directory after reopening")
+	}
+	if deleted, err := store.del("deleted"); err != nil || deleted {
+		t.Fatalf("deleting a deleted key: got %v, %v", deleted, err)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir)
+	if err := store.set("a", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	var batch WriteBatch
+	batch.Put("a", []byte("batched"))
+	batch.Put("b", []byte("batched"))
+	batch.Delete("c")
+	if err := store.Write(&batch); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+	committed := store.dataFile.Size()
+
+	batch.Reset()
+	batch.Put("a", []byte("torn"))
+	batch.Put("d", []byte("torn"))
+	if err := store.Write(&batch); err != nil {
+		t.Fatalf("failed to write batch: %v", err)
+	}
+	for key, want := range map[string]string{"a": "torn", "b": "batched", "d": "torn"} {
+		if got, err := store.get(key); err != nil || string(got) != want {
+			t.Fatalf("get %s: got %q, %v, want %q", key, got, err, want)
+		}
+	}
+	store.Close()
+
+	// cut the commit marker off the second batch as a crash would, leaving
+	// only whole records behind
+	path := datafile.GetDatafile(filepath.Join(dir, ".data"), 1)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marker := int64(headerSize) + 4
+	if err := os.Truncate(path, info.Size()-marker); err != nil {
+		t.Fatal(err)
+	}
+
+	store = newTestStore(t, dir)
+	if store.dataFile.Size() != committed {
+		t.Fatalf("expected the open batch to be cut off at %d, datafile is %d bytes", committed, store.dataFile.Size())
+	}
+	if err := store.set("e", []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store = newTestStore(t, dir)
+	defer store.Close()
+	for key, want := range map[string]string{"a": "batched", "b": "batched", "e": "after"} {
+		if got, err := store.get(key); err != nil || string(got) != want {
+			t.Fatalf("get %s: got %q, %v, want %q", key, got, err, want)
+		}
+	}
+	if _, err := store.get("d"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("get d: expected the uncommitted batch to be dropped, got %v", err)
+	}
+	if got := store.executeCmd(NewCmd([][]byte{[]byte("MSET"), []byte("x"), []byte("1"), []byte("y")})); got[0] != '-' {
+		t.Fatalf("expected an error for an odd number of arguments, got %q", got)
+	}
+}
@@ -0,0 +1,487 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"go.uber.org/zap"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+	"github.com/ajaxchavan/bytecask/internal/datafile"
+	"github.com/ajaxchavan/bytecask/internal/log"
+)
+
+const (
+	// legacyHeaderSize is the size of the record header of the datafiles
+	// written before the format was versioned: the checksum of the value, the
+	// timestamp, and the sizes of the key and of the value, which is empty
+	// for a tombstone.
+	legacyHeaderSize = 16
+	// legacyHintFile is the hint file written along with them.
+	legacyHintFile = "key_hint.db"
+)
+
+// This file holds what the offline tools of the bytecask binary run on a
+// data directory no server has open: dump, fsck, repair, stats and upgrade.
+
+// FileStats describes what a datafile holds.
+type FileStats struct {
+	FileId int
+	Size   int64
+	// Live is the number of bytes the key directory points at.
+	Live       int64
+	Tombstones int64
+	// Dead is the number of bytes a merge would reclaim.
+	Dead int64
+	Keys int
+}
+
+// Stats returns the statistics of every datafile, oldest first.
+func (s *Store) Stats() []FileStats {
+	s.Lock()
+	defer s.Unlock()
+
+	keys := make(map[int]int)
+	s.KeyDir.Ascend("", func(_ string, meta Meta) bool {
+		keys[meta.FileId]++
+		return true
+	})
+
+	stats := make([]FileStats, 0, len(s.FileDir))
+	for _, fileId := range s.fileIds() {
+		stats = append(stats, FileStats{
+			FileId:     fileId,
+			Size:       int64(s.FileDir[fileId].Size()),
+			Live:       s.live[fileId],
+			Tombstones: s.tombstones[fileId],
+			Dead:       s.deadBytes(fileId),
+			Keys:       keys[fileId],
+		})
+	}
+	return stats
+}
+
+// fileIds returns the ids of the datafiles in order. The caller must hold the
+// store lock.
+func (s *Store) fileIds() []int {
+	ids := make([]int, 0, len(s.FileDir))
+	for fileId := range s.FileDir {
+		ids = append(ids, fileId)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// inspect opens the datafiles of dir for reading without loading them.
+func inspect(dir string) (*Store, error) {
+	cfg := config.NewConfig(config.WithDirectoryPath(""), config.WithDirectory(dir), config.WithReadOnly(true))
+	s := newStore(*cfg, log.Log{Logger: zap.NewNop()})
+
+	fileId, err := s.buildFileDir()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.FileId = fileId
+	s.publishFiles()
+	return s, nil
+}
+
+// walkDatafile calls fn with every record of dt, including the ones that fail
+// their checksum, for which it passes the error instead. It returns the
+// offset it stopped at, anything after is a torn tail.
+func walkDatafile(dt *datafile.Datafile, fn func(offset, size uint32, record *Record, err error) error) (uint32, error) {
+	var (
+		offset uint32
+		size   = uint32(dt.Size())
+		header Header
+	)
+	for offset+headerSize <= size {
+		headerObj, err := dt.Read(offset, headerSize)
+		if err != nil {
+			return offset, err
+		}
+		if err := header.decode(headerObj); err != nil {
+			return offset, err
+		}
+		if header.Timestamp == 0 {
+			return offset, nil
+		}
+		objectSize := uint64(headerSize) + uint64(header.KeySize) + uint64(header.ValSize)
+		if uint64(offset)+objectSize > uint64(size) {
+			return offset, nil
+		}
+
+		object, err := dt.Read(offset, uint32(objectSize))
+		if err != nil {
+			return offset, err
+		}
+		record, err := decodeRecord(object)
+		if err := fn(offset, uint32(objectSize), record, err); err != nil {
+			return offset, err
+		}
+		offset += uint32(objectSize)
+	}
+	return offset, nil
+}
+
+// dumpRecord is a record as written by Dump.
+type dumpRecord struct {
+	File      int    `json:"file"`
+	Offset    uint32 `json:"offset"`
+	Size      uint32 `json:"size"`
+	Type      string `json:"type,omitempty"`
+	Timestamp uint32 `json:"timestamp,omitempty"`
+	Expiry    uint64 `json:"expiry,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Value     []byte `json:"value,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Dump writes every record of the datafiles in dir to w, one JSON object per
+// line. Values are only written, base64 encoded, when values is set. Records
+// that fail their checksum and torn tails are written with an error.
+func Dump(dir string, w io.Writer, values bool) error {
+	s, err := inspect(dir)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	enc := json.NewEncoder(w)
+	for _, fileId := range s.fileIds() {
+		dt := s.FileDir[fileId]
+		end, err := walkDatafile(dt, func(offset, size uint32, record *Record, err error) error {
+			d := dumpRecord{File: fileId, Offset: offset, Size: size}
+			if err != nil {
+				d.Error = err.Error()
+				return enc.Encode(d)
+			}
+			d.Type = record.Type.String()
+			d.Timestamp = record.Timestamp
+			d.Expiry = record.Expiry
+			d.Key = record.Key
+			if values && record.Type == recordValue {
+				d.Value = record.Value
+			}
+			return enc.Encode(d)
+		})
+		if err != nil {
+			return fmt.Errorf("datafile %d: %w", fileId, err)
+		}
+		if int(end) < dt.Size() {
+			if err := enc.Encode(dumpRecord{File: fileId, Offset: end, Size: uint32(dt.Size()) - end, Error: "torn tail"}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Fsck checks the datafiles in dir and writes what it finds to w: records
+// that fail their checksum, torn tails, batches left open, and hint files
+// that do not agree with their datafile. It returns the number of problems
+// found.
+func Fsck(dir string, w io.Writer) (int, error) {
+	s, err := inspect(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	problems := 0
+	report := func(format string, args ...interface{}) {
+		problems++
+		fmt.Fprintf(w, format+"\n", args...)
+	}
+
+	for _, fileId := range s.fileIds() {
+		dt := s.FileDir[fileId]
+		name := filepath.Base(datafile.GetDatafile(s.dir(), fileId))
+		before := problems
+
+		records, corrupt := 0, 0
+		end, err := walkDatafile(dt, func(offset, size uint32, _ *Record, err error) error {
+			records++
+			if err != nil {
+				corrupt++
+				report("%s: corrupt record of %d bytes at offset %d", name, size, offset)
+			}
+			return nil
+		})
+		if err != nil {
+			return problems, fmt.Errorf("%s: %w", name, err)
+		}
+		if int(end) < dt.Size() {
+			report("%s: torn tail of %d bytes at offset %d", name, uint32(dt.Size())-end, end)
+		}
+		if corrupt > 0 {
+			continue
+		}
+
+		entries, valid, err := s.scanHintEntries(dt)
+		if err != nil {
+			return problems, fmt.Errorf("%s: %w", name, err)
+		}
+		if valid < end {
+			report("%s: batch left open at offset %d", name, valid)
+		}
+		s.checkHintFile(fileId, dt, entries, report)
+
+		if problems == before {
+			fmt.Fprintf(w, "%s: ok, %d records in %d bytes\n", name, records, dt.Size())
+		}
+	}
+
+	hints, err := filepath.Glob(filepath.Join(s.dir(), "data_*.hint"))
+	if err != nil {
+		return problems, err
+	}
+	for _, hint := range hints {
+		id, err := strconv.Atoi(hint[len(filepath.Join(s.dir(), "data_")) : len(hint)-len(".hint")])
+		if _, ok := s.FileDir[id]; err != nil || !ok {
+			report("%s: hint file without a datafile", filepath.Base(hint))
+		}
+	}
+	return problems, nil
+}
+
+// checkHintFile compares the hint file of the datafile identified by fileId
+// with the entries scanned from the datafile.
+func (s *Store) checkHintFile(fileId int, dt *datafile.Datafile, entries []hintEntry, report func(format string, args ...interface{})) {
+	name := filepath.Base(GetHintFile(s.dir(), fileId))
+	hinted, err := s.readHintFile(fileId, dt)
+	if errors.Is(err, os.ErrNotExist) {
+		// written when the datafile is sealed or on the next start
+		return
+	}
+	if err != nil {
+		report("%s: %v", name, err)
+		return
+	}
+
+	if len(hinted) != len(entries) {
+		report("%s: holds %d keys, the datafile %d", name, len(hinted), len(entries))
+		return
+	}
+	for i := range entries {
+		if hinted[i] != entries[i] {
+			report("%s: entry for key %q does not match the datafile", name, entries[i].Key)
+			return
+		}
+	}
+}
+
+// Repair truncates the torn tails of the datafiles in dir and writes their
+// hint files afresh, reporting what it does to w. A datafile with a corrupt
+// record before its end is left alone. The directory is locked meanwhile, so
+// it fails if a server has it open.
+func Repair(dir string, w io.Writer) error {
+	lock, err := lockDirectory(dir)
+	if err != nil {
+		return err
+	}
+	defer unlockDirectory(lock)
+
+	if err := removeTempFiles(dir); err != nil {
+		return err
+	}
+	s, err := inspect(dir)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	failed := 0
+	for _, fileId := range s.fileIds() {
+		dt := s.FileDir[fileId]
+		path := datafile.GetDatafile(s.dir(), fileId)
+		name := filepath.Base(path)
+
+		entries, end, err := s.scanHintEntries(dt)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "%s: cannot repair: %v\n", name, err)
+			continue
+		}
+		if int(end) < dt.Size() {
+			df, err := datafile.New(path)
+			if err == nil {
+				err = df.Truncate(int(end))
+				df.Close()
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			fmt.Fprintf(w, "%s: truncated %d bytes of torn tail at offset %d\n", name, dt.Size()-int(end), end)
+		}
+		if err := writeHintFile(GetHintFile(s.dir(), fileId), entries, end); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Fprintf(w, "%s: wrote hint file with %d entries\n", name, len(entries))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d datafiles could not be repaired", failed)
+	}
+	return nil
+}
+
+// Stats loads the data directory dir and writes the live, tombstone and dead
+// bytes of every datafile to w.
+func Stats(dir string, w io.Writer) error {
+	s, err := inspect(dir)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.buildKeyDir(); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "file\tsize\tlive\ttombstones\tdead\tdead %\tkeys\t")
+	var total FileStats
+	for _, st := range s.Stats() {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%d\t\n", filepath.Base(datafile.GetDatafile(s.dir(), st.FileId)),
+			st.Size, st.Live, st.Tombstones, st.Dead, percent(st.Dead, st.Size), st.Keys)
+		total.Size += st.Size
+		total.Live += st.Live
+		total.Tombstones += st.Tombstones
+		total.Dead += st.Dead
+		total.Keys += st.Keys
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\t%d\t%d\t%s\t%d\t\n",
+		total.Size, total.Live, total.Tombstones, total.Dead, percent(total.Dead, total.Size), total.Keys)
+	return tw.Flush()
+}
+
+func percent(n, of int64) string {
+	if of == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f", 100*float64(n)/float64(of))
+}
+
+// Upgrade rewrites the datafiles in dir written before the format was
+// versioned in the current format, reporting what it does to w. Datafiles
+// already in the current format are left alone, so it can be run again after
+// a failure. A datafile with a corrupt record before its end is refused. The
+// directory is locked meanwhile, so it fails if a server has it open.
+func Upgrade(dir string, w io.Writer) error {
+	lock, err := lockDirectory(dir)
+	if err != nil {
+		return err
+	}
+	defer unlockDirectory(lock)
+
+	if err := removeTempFiles(dir); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !fileRegex.MatchString(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		dt, err := datafile.Open(path)
+		if err == nil {
+			dt.Close()
+			continue
+		}
+		if !errors.Is(err, datafile.ErrUnknownFormat) {
+			return err
+		}
+
+		records, torn, err := upgradeDatafile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		fmt.Fprintf(w, "%s: rewrote %d records", entry.Name(), records)
+		if torn > 0 {
+			fmt.Fprintf(w, ", dropped %d bytes of torn tail", torn)
+		}
+		fmt.Fprintln(w)
+	}
+
+	// the hint files are written again on the next start
+	if err := os.Remove(filepath.Join(dir, legacyHintFile)); err == nil {
+		fmt.Fprintf(w, "%s: removed\n", legacyHintFile)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return syncDirectory(dir)
+}
+
+// upgradeDatafile rewrites the datafile at path from the format used before
+// it was versioned. It returns the number of records and the size of the
+// torn tail dropped.
+func upgradeDatafile(path string) (int, int, error) {
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	tmp := path + tempExt
+	dt, err := datafile.New(tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(tmp)
+	defer dt.Close()
+
+	var (
+		buffer  bytes.Buffer
+		records int
+		offset  int
+	)
+	for offset+legacyHeaderSize <= len(old) {
+		h := old[offset:]
+		crc := binary.BigEndian.Uint32(h)
+		keySize := uint64(binary.BigEndian.Uint32(h[8:]))
+		valSize := uint64(binary.BigEndian.Uint32(h[12:]))
+		if uint64(len(h)) < legacyHeaderSize+keySize+valSize {
+			break
+		}
+		key := string(h[legacyHeaderSize : legacyHeaderSize+keySize])
+		value := h[legacyHeaderSize+keySize : legacyHeaderSize+keySize+valSize]
+		if crc32.ChecksumIEEE(value) != crc {
+			return records, 0, fmt.Errorf("%w at offset %d", ErrCorruptRecord, offset)
+		}
+
+		record := newRecord(key, value, recordValue, 0)
+		if valSize == 0 {
+			record = newRecord(key, nil, recordTombstone, 0)
+		}
+		record.Timestamp = binary.BigEndian.Uint32(h[4:])
+		buffer.Reset()
+		if err := record.encode(&buffer); err != nil {
+			return records, 0, err
+		}
+		if _, err := dt.Append(buffer.Bytes()); err != nil {
+			return records, 0, err
+		}
+		records++
+		offset += legacyHeaderSize + int(keySize+valSize)
+	}
+
+	if err := dt.Flush(); err != nil {
+		return records, 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return records, 0, err
+	}
+	return records, len(old) - offset, nil
+}
@@ -0,0 +1,206 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+	"github.com/ajaxchavan/bytecask/internal/datafile"
+)
+
+func TestTools(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestStore(t, dir, config.WithMaxDatafileSize(256))
+	for i := 0; i < 30; i++ {
+		if err := store.set(fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.del("key00"); err != nil {
+		t.Fatal(err)
+	}
+	newest := store.FileId
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(dir, ".data")
+
+	fsck := func() (int, string) {
+		t.Helper()
+		var out bytes.Buffer
+		problems, err := Fsck(data, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return problems, out.String()
+	}
+	if problems, out := fsck(); problems != 0 {
+		t.Fatalf("fsck of a clean directory found %d problems:\n%s", problems, out)
+	}
+
+	var out bytes.Buffer
+	if err := Dump(data, &out, true); err != nil {
+		t.Fatal(err)
+	}
+	values := 0
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var d dumpRecord
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			t.Fatalf("dump line %q: %v", line, err)
+		}
+		if d.Error != "" {
+			t.Fatalf("dump of a clean directory: %q", line)
+		}
+		if d.Type == "value" {
+			values++
+		}
+	}
+	if values != 30 {
+		t.Fatalf("dump: got %d values, want 30", values)
+	}
+
+	out.Reset()
+	if err := Stats(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if total := strings.Fields(lines[len(lines)-1]); total[0] != "total" || total[len(total)-1] != "29" {
+		t.Fatalf("stats:\n%s", out.String())
+	}
+
+	// a torn tail and a stale hint file are found and repaired
+	f, err := os.OpenFile(datafile.GetDatafile(data, newest), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, headerSize+3)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	hint, err := os.ReadFile(GetHintFile(data, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(GetHintFile(data, 1), hint[:len(hint)-1], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if problems, out := fsck(); problems != 2 {
+		t.Fatalf("fsck: got %d problems, want 2:\n%s", problems, out)
+	}
+
+	out.Reset()
+	if err := Repair(data, &out); err != nil {
+		t.Fatalf("repair: %v\n%s", err, out.String())
+	}
+	if problems, out := fsck(); problems != 0 {
+		t.Fatalf("fsck after repair found %d problems:\n%s", problems, out)
+	}
+	store = newTestStore(t, dir)
+	for i := 1; i < 30; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if got, err := store.get(key); err != nil || string(got) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("get %s after repair: got %q, %v", key, got, err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a corrupt record before the end of a datafile cannot be repaired
+	path := datafile.GetDatafile(data, 1)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[datafile.HeaderSize+headerSize] ^= 0xff
+	if err := os.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if problems, out := fsck(); problems == 0 || !strings.Contains(out, "corrupt record") {
+		t.Fatalf("fsck missed a corrupt record:\n%s", out)
+	}
+	if err := Repair(data, &bytes.Buffer{}); err == nil {
+		t.Fatal("repair of a corrupt record succeeded")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, ".data")
+	if err := os.MkdirAll(data, 0777); err != nil {
+		t.Fatal(err)
+	}
+	// records as written before the format was versioned
+	legacy := func(key, value string) []byte {
+		b := binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE([]byte(value)))
+		b = binary.BigEndian.AppendUint32(b, 1700000000)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(key)))
+		b = binary.BigEndian.AppendUint32(b, uint32(len(value)))
+		return append(append(b, key...), value...)
+	}
+	files := map[int][]byte{
+		1: append(legacy("a", "1"), legacy("b", "2")...),
+		2: append(append(legacy("a", ""), legacy("c", "3")...), legacy("d", "torn")[:10]...),
+		3: nil,
+	}
+	for fileId, b := range files {
+		if err := os.WriteFile(datafile.GetDatafile(data, fileId), b, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(data, legacyHintFile), []byte("gob"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := Upgrade(data, &out); err != nil {
+		t.Fatalf("upgrade: %v\n%s", err, out.String())
+	}
+	for _, want := range []string{"data_1.db: rewrote 2 records\n", "data_2.db: rewrote 2 records, dropped 10 bytes of torn tail\n", legacyHintFile + ": removed\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("upgrade did not report %q:\n%s", want, out.String())
+		}
+	}
+	if problems, err := Fsck(data, &out); err != nil || problems != 0 {
+		t.Fatalf("fsck after upgrade found %d problems, %v:\n%s", problems, err, out.String())
+	}
+
+	// running it again leaves the upgraded datafiles alone
+	out.Reset()
+	if err := Upgrade(data, &out); err != nil || out.Len() != 0 {
+		t.Fatalf("second upgrade: %v\n%s", err, out.String())
+	}
+
+	store := newTestStore(t, dir)
+	for key, want := range map[string]string{"b": "2", "c": "3"} {
+		if got, err := store.get(key); err != nil || string(got) != want {
+			t.Fatalf("get %s: got %q, %v", key, got, err)
+		}
+	}
+	for _, key := range []string{"a", "d"} {
+		if _, ok := store.lookup(key); ok {
+			t.Fatalf("%s survived the upgrade", key)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a corrupt record is refused
+	bad := legacy("e", "5")
+	bad[len(bad)-1] ^= 0xff
+	if err := os.WriteFile(datafile.GetDatafile(data, 9), bad, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := Upgrade(data, &out); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatalf("upgrade of a corrupt record: got %v", err)
+	}
+}
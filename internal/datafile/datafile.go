@@ -1,10 +1,14 @@
 package datafile
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/ajaxchavan/bytecask/internal/log"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 )
 
 type Datafile struct {
@@ -12,35 +16,139 @@ type Datafile struct {
 	writer *os.File
 	Reader *os.File
 	offset int
+	// mapped is set once a sealed Datafile is mapped into memory.
+	mapped atomic.Pointer[mapping]
 }
 
 type FileDir map[int]*Datafile
 
 const (
 	InvalidOffset = -1
+)
 
-	// debug
-	dataFileSizeMax = 128
+const (
+	// HeaderSize is the size of the header every datafile starts with: a
+	// magic number followed by the version of the format. Offsets into a
+	// Datafile count from the end of the header.
+	HeaderSize = 8
+	// Version is the version of the format datafiles are written in.
+	Version = 1
 )
 
-// New creates a new Datafile instance with the given file path.
+// magic tells a datafile apart from any other file.
+var magic = [4]byte{'B', 'C', 'S', 'K'}
+
+// header returns the header of a datafile in the current format.
+func header() []byte {
+	return binary.BigEndian.AppendUint32(magic[:], Version)
+}
+
+// checkHeader verifies the header of the datafile f holding size bytes and
+// reports whether f holds no complete header yet, which is only left behind
+// by a crash right after the file was created.
+func checkHeader(f *os.File, size int64) (bool, error) {
+	b := make([]byte, min(size, HeaderSize))
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return false, err
+	}
+	want := header()
+	if size < HeaderSize && bytes.Equal(b, want[:size]) {
+		return true, nil
+	}
+	if size < HeaderSize || !bytes.Equal(b[:len(magic)], magic[:]) {
+		return false, fmt.Errorf("%w: %s is not a datafile, or was written by an older version, see bytecask upgrade", ErrUnknownFormat, f.Name())
+	}
+	if version := binary.BigEndian.Uint32(b[len(magic):]); version != Version {
+		return false, fmt.Errorf("%w: %s has version %d, want %d", ErrUnknownFormat, f.Name(), version, Version)
+	}
+	return false, nil
+}
+
+// New creates a new Datafile instance with the given file path. When the file
+// already exists it is reopened for appending and the offset picks up at its
+// current end. A file that is not a datafile in the current format is
+// refused with ErrUnknownFormat.
 func New(filePath string) (*Datafile, error) {
 	writer, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		return nil, err
 	}
 
+	stat, err := writer.Stat()
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+
 	reader, err := os.Open(filePath)
 	if err != nil {
 		writer.Close()
 		return nil, err
 	}
 
+	size := stat.Size()
+	fresh := size == 0
+	if !fresh {
+		if fresh, err = checkHeader(reader, size); err != nil {
+			writer.Close()
+			reader.Close()
+			return nil, err
+		}
+	}
+	if fresh {
+		// a partial header is written again from scratch
+		if size > 0 {
+			err = writer.Truncate(0)
+		}
+		if err == nil {
+			_, err = writer.Write(header())
+		}
+		if err != nil {
+			writer.Close()
+			reader.Close()
+			return nil, err
+		}
+		size = HeaderSize
+	}
+
 	return &Datafile{
 		//logger: logger,
 		writer: writer,
 		Reader: reader,
-		offset: 0,
+		offset: int(size - HeaderSize),
+	}, nil
+}
+
+// Open opens an existing Datafile with the given file path for reading only.
+// A file that is not a datafile in the current format is refused with
+// ErrUnknownFormat.
+func Open(filePath string) (*Datafile, error) {
+	reader, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := reader.Stat()
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	size := stat.Size()
+	if size > 0 {
+		fresh, err := checkHeader(reader, size)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		if fresh {
+			size = 0
+		}
+	}
+
+	return &Datafile{
+		Reader: reader,
+		offset: int(max(size-HeaderSize, 0)),
 	}, nil
 }
 
@@ -76,18 +184,66 @@ func (d *Datafile) Append(data []byte) (int, error) {
 // Read reads data from the Datafile starting at the specified offset (off)
 // and reads the specified number of bytes (size)
 func (d *Datafile) Read(off uint32, size uint32) ([]byte, error) {
+	if d.mapped.Load() != nil {
+		var buff []byte
+		err := d.View(off, size, func(b []byte) error {
+			buff = append(make([]byte, 0, size), b...)
+			return nil
+		})
+		return buff, err
+	}
+
 	buff := make([]byte, size)
 
-	if _, err := d.Reader.ReadAt(buff, int64(off)); err != nil {
+	if _, err := d.Reader.ReadAt(buff, int64(off)+HeaderSize); err != nil {
 		return nil, err
 	}
 
 	return buff, nil
 }
 
-// IsFull checks whether the data file associated with the Datafile instance
-// is nearly full (95%)
-func (d *Datafile) IsFull() bool {
-	frac := float32(d.offset) / float32(dataFileSizeMax)
-	return frac >= 0.95
+// Size returns the number of bytes written to the Datafile.
+func (d *Datafile) Size() int {
+	return d.offset
+}
+
+// IsFull checks whether appending n more bytes would grow the Datafile past
+// maxSize. An empty Datafile is never full, so a single record larger than
+// maxSize still gets a file of its own.
+func (d *Datafile) IsFull(maxSize int64, n int) bool {
+	return d.offset > 0 && int64(d.offset+n) > maxSize
+}
+
+// Truncate cuts the Datafile down to size bytes, dropping everything written
+// after it.
+func (d *Datafile) Truncate(size int) error {
+	if err := d.writer.Truncate(int64(size) + HeaderSize); err != nil {
+		return err
+	}
+	d.offset = size
+	return d.writer.Sync()
+}
+
+// Close closes the Datafile for both reading and writing. A mapped Datafile
+// is unmapped once the views in use are done with it.
+func (d *Datafile) Close() error {
+	if d.writer != nil {
+		if err := d.writer.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+	if m := d.mapped.Swap(nil); m != nil {
+		if err := m.release(); err != nil {
+			return err
+		}
+	}
+	return d.Reader.Close()
+}
+
+// Seal flushes the Datafile and closes it for writing. It can still be read.
+func (d *Datafile) Seal() error {
+	if err := d.writer.Sync(); err != nil {
+		return err
+	}
+	return d.writer.Close()
 }
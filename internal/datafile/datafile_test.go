@@ -1,6 +1,8 @@
 package datafile
 
 import (
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
@@ -87,15 +89,25 @@ func TestIsFull(t *testing.T) {
 		df.Reader.Close()
 	}()
 
+	const maxSize = 128
+
+	// an empty file takes a record of any size
+	if df.IsFull(maxSize, maxSize+1) {
+		t.Error("expected empty Datafile not to be full")
+	}
+
 	// Append some data to make file nearly full
-	data := make([]byte, dataFileSizeMax-1)
+	data := make([]byte, maxSize-1)
 	_, err = df.Append(data)
 	if err != nil {
 		t.Fatalf("error appending data: %v", err)
 	}
 
 	// Test IsFull function
-	if !df.IsFull() {
+	if df.IsFull(maxSize, 1) {
+		t.Error("expected Datafile to fit one more byte")
+	}
+	if !df.IsFull(maxSize, 2) {
 		t.Error("expected Datafile to be full")
 	}
 }
@@ -111,3 +123,145 @@ func NewDatafile(dir string) (*Datafile, error) {
 	}
 	return df, nil
 }
+
+func TestReopenOffset(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	df, err := NewDatafile(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create new Datafile: %v", err)
+	}
+	data := []byte("test data")
+	if _, err := df.Append(data); err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	df.Close()
+
+	// reopening an existing file must continue at its end
+	df, err = NewDatafile(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen Datafile: %v", err)
+	}
+	defer df.Close()
+
+	offset, err := df.Append(data)
+	if err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if offset != len(data) {
+		t.Errorf("expected offset %v, got %v", len(data), offset)
+	}
+
+	if err := df.Truncate(len(data)); err != nil {
+		t.Fatalf("error truncating: %v", err)
+	}
+	if df.Size() != len(data) {
+		t.Errorf("expected size %v after truncate, got %v", len(data), df.Size())
+	}
+}
+
+func TestMap(t *testing.T) {
+	df, err := NewDatafile(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create new Datafile: %v", err)
+	}
+	if _, err := df.Append([]byte("hello mapped world")); err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	if err := df.Seal(); err != nil {
+		t.Fatalf("error sealing: %v", err)
+	}
+	if err := df.Map(); err != nil {
+		t.Fatalf("error mapping: %v", err)
+	}
+
+	if got, err := df.Read(6, 6); err != nil || string(got) != "mapped" {
+		t.Fatalf("read: got %q, %v", got, err)
+	}
+	if err := df.View(100, 1, func([]byte) error { return nil }); err != io.EOF {
+		t.Fatalf("view past the end: got %v, want %v", err, io.EOF)
+	}
+
+	// closing the datafile while a view is in use leaves it readable until
+	// the view returns
+	err = df.View(0, 5, func(b []byte) error {
+		if err := df.Close(); err != nil {
+			t.Fatalf("error closing: %v", err)
+		}
+		if string(b) != "hello" {
+			t.Fatalf("view: got %q after close", b)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("view: %v", err)
+	}
+	if err := df.View(0, 5, func([]byte) error { return nil }); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("view after close: got %v, want %v", err, os.ErrClosed)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data_1.db")
+
+	df, err := New(path)
+	if err != nil {
+		t.Fatalf("failed to create new Datafile: %v", err)
+	}
+	if _, err := df.Append([]byte("record")); err != nil {
+		t.Fatalf("error appending data: %v", err)
+	}
+	df.Close()
+
+	// offsets count from the end of the header
+	for _, open := range []func(string) (*Datafile, error){New, Open} {
+		df, err := open(path)
+		if err != nil {
+			t.Fatalf("failed to reopen Datafile: %v", err)
+		}
+		if got, err := df.Read(0, 6); err != nil || string(got) != "record" || df.Size() != 6 {
+			t.Fatalf("read: got %q, %v with size %d", got, err, df.Size())
+		}
+		df.Close()
+	}
+
+	for name, b := range map[string][]byte{
+		"no header":   []byte("\x00\x00\x00\x01\x00\x00\x00\x02 an older datafile"),
+		"new version": []byte("BCSK\x00\x00\x00\x02"),
+		"short":       []byte("BCSX"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, b, 0666); err != nil {
+				t.Fatal(err)
+			}
+			for _, open := range []func(string) (*Datafile, error){New, Open} {
+				if _, err := open(path); !errors.Is(err, ErrUnknownFormat) {
+					t.Fatalf("got %v, want %v", err, ErrUnknownFormat)
+				}
+			}
+			if got, _ := os.ReadFile(path); string(got) != string(b) {
+				t.Fatalf("refused file changed to %q", got)
+			}
+		})
+	}
+
+	// a header cut short by a crash right after the file was created is
+	// written again
+	path = filepath.Join(dir, "torn")
+	if err := os.WriteFile(path, []byte("BCS"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	df, err = New(path)
+	if err != nil {
+		t.Fatalf("failed to reopen Datafile with a torn header: %v", err)
+	}
+	defer df.Close()
+	if df.Size() != 0 {
+		t.Fatalf("got size %d, want 0", df.Size())
+	}
+	if got, _ := os.ReadFile(path); string(got) != string(header()) {
+		t.Fatalf("got %q, want the header", got)
+	}
+}
@@ -2,6 +2,9 @@ package datafile
 
 const (
 	ErrEmptyData Error = "empty data"
+	// ErrUnknownFormat is returned for a file that is not a datafile in the
+	// format this version writes.
+	ErrUnknownFormat Error = "unknown datafile format"
 )
 
 type Error string
@@ -0,0 +1,80 @@
+package datafile
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// mapping is a read-only memory mapping of a sealed datafile. It counts one
+// reference for the Datafile and one for every view of it in use, and is
+// unmapped once the last one is released, so closing a Datafile never pulls
+// the memory from under a reader.
+type mapping struct {
+	data []byte
+	refs atomic.Int64
+}
+
+// acquire takes a reference to the mapping, unless it is already unmapped.
+func (m *mapping) acquire() bool {
+	for {
+		refs := m.refs.Load()
+		if refs == 0 {
+			return false
+		}
+		if m.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference to the mapping and unmaps it with the last one.
+func (m *mapping) release() error {
+	if m.refs.Add(-1) > 0 {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return munmap(data)
+}
+
+// Map maps the Datafile into memory, after which reads no longer go through
+// a system call. It must only be called once nothing is appended to the
+// Datafile anymore. Where mapping is not supported reads go on unchanged.
+func (d *Datafile) Map() error {
+	if d.offset == 0 || d.mapped.Load() != nil {
+		return nil
+	}
+	data, err := mmap(d.Reader, d.offset+HeaderSize)
+	if err != nil {
+		return err
+	}
+	m := &mapping{data: data}
+	m.refs.Store(1)
+	d.mapped.Store(m)
+	return nil
+}
+
+// View calls fn with the size bytes at off. When the Datafile is mapped they
+// are a slice of the mapping rather than a copy: fn must neither change them
+// nor keep them after it returns.
+func (d *Datafile) View(off uint32, size uint32, fn func(b []byte) error) error {
+	m := d.mapped.Load()
+	if m == nil {
+		b, err := d.Read(off, size)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	}
+
+	if !m.acquire() {
+		return os.ErrClosed
+	}
+	defer m.release()
+	start := uint64(off) + HeaderSize
+	if start+uint64(size) > uint64(len(m.data)) {
+		return io.EOF
+	}
+	return fn(m.data[start : start+uint64(size) : start+uint64(size)])
+}
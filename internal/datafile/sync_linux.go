@@ -0,0 +1,26 @@
+//go:build linux
+
+package datafile
+
+import "syscall"
+
+// SyncData writes the appended data to disk like Flush, but leaves out the
+// metadata that is not needed to read it back, such as the modification time.
+func (d *Datafile) SyncData() error {
+	conn, err := d.writer.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var syncErr error
+	if err := conn.Control(func(fd uintptr) {
+		for {
+			syncErr = syscall.Fdatasync(int(fd))
+			if syncErr != syscall.EINTR {
+				return
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return syncErr
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package datafile
+
+// SyncData writes the appended data to disk. Without fdatasync it is Flush.
+func (d *Datafile) SyncData() error {
+	return d.Flush()
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+
+	"github.com/ajaxchavan/bytecask/internal/core"
+)
+
+// connection holds the per client state kept by the event loop between
+// readiness notifications: the parser with any partially received command,
+// the session with any open transaction, and the replies that could not be
+// written to the socket yet.
+type connection struct {
+	client  *core.Client
+	parser  *core.RespParser
+	session *core.Session
+	out     bytes.Buffer
+	// closing is set once the client has gone away while replies were
+	// still pending, the connection is closed as soon as they are written.
+	closing bool
+	// unsynced is the count of appends that must be on disk before the
+	// pending replies are sent, syncing is set while they are held back for
+	// it. The client is not read from meanwhile.
+	unsynced uint64
+	syncing  bool
+}
+
+func newConnection(fd int, store *core.Store) *connection {
+	client := core.NewClient(fd)
+	parser, _ := core.NewParser(client)
+	session := store.NewSession()
+	session.DeferSyncs()
+	return &connection{
+		client:  client,
+		parser:  parser,
+		session: session,
+	}
+}
+
+// handle reads what the client has sent, runs every complete command in the
+// order it arrived and writes the replies back in one batch, unless they
+// must wait for a sync. It returns an error when the connection should be
+// closed.
+func (c *connection) handle() error {
+	cmds, err := c.parser.DecodeCmds()
+	if len(cmds) > 0 {
+		c.session.EvalAndResponse(cmds, &c.out)
+		c.unsynced = c.session.Unsynced()
+	}
+	if errors.Is(err, core.ErrProtocol) {
+		c.out.Write(core.Encode(err, false))
+	}
+
+	if c.unsynced == 0 {
+		if ferr := c.flush(); ferr != nil {
+			return ferr
+		}
+	}
+	if err != nil && !errors.Is(err, syscall.EAGAIN) {
+		return err
+	}
+	return nil
+}
+
+// flush writes as much of the pending replies as the socket accepts.
+func (c *connection) flush() error {
+	for c.out.Len() > 0 {
+		n, err := c.client.Write(c.out.Bytes())
+		if n > 0 {
+			c.out.Next(n)
+		}
+		if err != nil {
+			if errors.Is(err, syscall.EAGAIN) {
+				return nil
+			}
+			return err
+		}
+	}
+	c.out.Reset()
+	return nil
+}
+
+// pending reports whether some replies are still waiting for the socket to
+// become writable.
+func (c *connection) pending() bool {
+	return c.out.Len() > 0
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+
+	"go.uber.org/zap"
+
+	"github.com/ajaxchavan/bytecask/internal/core"
+)
+
+// errSyncFailed replaces the replies to writes whose sync failed.
+var errSyncFailed = errors.New("ERR writes could not be synced to disk")
+
+const (
+	// maxEvents is the number of ready file descriptors handled per epoll_wait.
+	maxEvents = 1024
+
+	readEvents  = syscall.EPOLLIN | syscall.EPOLLRDHUP
+	writeEvents = syscall.EPOLLOUT
+	closeEvents = syscall.EPOLLHUP | syscall.EPOLLERR
+)
+
+// serve runs a single threaded epoll reactor. The listening socket and every
+// client socket are registered with epoll and only touched once the kernel
+// reports them ready, so idle connections cost nothing but their buffers.
+func serve(ctx context.Context, serverFd int, store *core.Store) error {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(epfd)
+
+	// the read end of the pipe becomes readable once ctx is cancelled, which
+	// wakes the loop up without having to poll with a timeout
+	var wake [2]int
+	if err := syscall.Pipe2(wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		return err
+	}
+	defer syscall.Close(wake[0])
+	defer syscall.Close(wake[1])
+	go func() {
+		<-ctx.Done()
+		_, _ = syscall.Write(wake[1], []byte{0})
+	}()
+
+	waiter, err := newSyncWaiter(store)
+	if err != nil {
+		return err
+	}
+	defer waiter.Close()
+
+	for _, fd := range []int{serverFd, wake[0], waiter.fd()} {
+		if err := epollAdd(epfd, fd); err != nil {
+			return err
+		}
+	}
+
+	conns := make(map[int]*connection)
+	defer func() {
+		for fd := range conns {
+			syscall.Close(fd)
+		}
+	}()
+	closeConn := func(c *connection, err error) {
+		fd := c.client.Fd()
+		if !errors.Is(err, io.EOF) {
+			store.Log.Debug("closing connection", zap.Int("fd", fd), zap.Error(err))
+		}
+		// closing the socket also removes it from the epoll set
+		syscall.Close(fd)
+		delete(conns, fd)
+	}
+
+	events := make([]syscall.EpollEvent, maxEvents)
+	for {
+		n, err := syscall.EpollWait(epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			switch fd {
+			case wake[0]:
+				store.Log.Info("stopping event loop")
+				return nil
+			case serverFd:
+				accept(epfd, serverFd, conns, store)
+			case waiter.fd():
+				for _, r := range waiter.results() {
+					// the client may have gone away, and its descriptor been
+					// reused, while the sync was waited for
+					if conns[r.c.client.Fd()] != r.c {
+						continue
+					}
+					if err := resume(epfd, r.c, r.err, store); err != nil {
+						closeConn(r.c, err)
+					}
+				}
+			default:
+				c, ok := conns[fd]
+				if !ok {
+					continue
+				}
+				if err := handleEvent(epfd, c, events[i].Events, waiter); err != nil {
+					closeConn(c, err)
+				}
+			}
+		}
+	}
+}
+
+// handleEvent serves one readiness notification for a client. While replies
+// are waiting for the socket to drain the connection is only polled for
+// writability, so a client that does not read its replies stops being read
+// from instead of growing the reply buffer without bound. Replies that must
+// wait for a sync are held back the same way while waiter waits for it, so
+// the loop goes on serving the other clients.
+func handleEvent(epfd int, c *connection, events uint32, waiter *syncWaiter) error {
+	fd := c.client.Fd()
+	if events&closeEvents != 0 {
+		return io.EOF
+	}
+	if c.syncing {
+		return nil
+	}
+
+	if events&syscall.EPOLLOUT != 0 {
+		if err := c.flush(); err != nil {
+			return err
+		}
+		if c.pending() {
+			return nil
+		}
+		if c.closing {
+			return io.EOF
+		}
+		return epollMod(epfd, fd, readEvents)
+	}
+
+	if events&(syscall.EPOLLIN|syscall.EPOLLRDHUP) == 0 {
+		return nil
+	}
+	if err := c.handle(); err != nil {
+		if (!errors.Is(err, io.EOF) && c.unsynced == 0) || !c.pending() {
+			return err
+		}
+		// the client closed its end after sending, or the replies wait for
+		// a sync, deliver them first
+		c.closing = true
+	}
+	if c.unsynced > 0 {
+		waiter.wait(c, c.unsynced)
+		c.unsynced, c.syncing = 0, true
+		// only hang ups are reported without any event asked for
+		return epollMod(epfd, fd, 0)
+	}
+	if c.pending() {
+		return epollMod(epfd, fd, writeEvents)
+	}
+	return nil
+}
+
+// resume sends the replies c held back once the sync they waited for is
+// done, and goes back to reading from the client. When the sync failed the
+// writes they acknowledge may be lost: the replies are replaced by an error
+// and the connection is closed.
+func resume(epfd int, c *connection, err error, store *core.Store) error {
+	c.syncing = false
+	if err != nil {
+		store.Log.Debug("failing connection after a failed sync", zap.Int("fd", c.client.Fd()), zap.Error(err))
+		c.out.Reset()
+		c.out.Write(core.Encode(errSyncFailed, false))
+		c.closing = true
+	}
+
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if c.pending() {
+		return epollMod(epfd, c.client.Fd(), writeEvents)
+	}
+	if c.closing {
+		return io.EOF
+	}
+	return epollMod(epfd, c.client.Fd(), readEvents)
+}
+
+// accept accepts every pending connection on the listening socket.
+func accept(epfd, serverFd int, conns map[int]*connection, store *core.Store) {
+	for {
+		fd, _, err := syscall.Accept4(serverFd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		if err != nil {
+			if !errors.Is(err, syscall.EAGAIN) && !errors.Is(err, syscall.ECONNABORTED) {
+				store.Log.Error("failed to accept connection", zap.Error(err))
+			}
+			return
+		}
+
+		if err := epollAdd(epfd, fd); err != nil {
+			store.Log.Error("failed to register connection", zap.Error(err))
+			syscall.Close(fd)
+			continue
+		}
+		conns[fd] = newConnection(fd, store)
+	}
+}
+
+func epollAdd(epfd, fd int) error {
+	event := syscall.EpollEvent{
+		Events: readEvents,
+		Fd:     int32(fd),
+	}
+	return syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &event)
+}
+
+func epollMod(epfd, fd int, events uint32) error {
+	event := syscall.EpollEvent{
+		Events: events,
+		Fd:     int32(fd),
+	}
+	return syscall.EpollCtl(epfd, syscall.EPOLL_CTL_MOD, fd, &event)
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+	"github.com/ajaxchavan/bytecask/internal/core"
+	"github.com/ajaxchavan/bytecask/internal/log"
+)
+
+// startServer runs the event loop over a store in a temporary directory on a
+// free port and returns the store and the address to dial.
+func startServer(t *testing.T, opts ...config.OptFunc) (*core.Store, string) {
+	t.Helper()
+
+	opts = append([]config.OptFunc{config.WithDirectoryPath(t.TempDir())}, opts...)
+	store, err := core.New(*config.NewConfig(opts...), log.Log{Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+
+	fd, err := listen(0)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatalf("failed to get the listening address: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, fd, store)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("event loop failed: %v", err)
+		}
+		syscall.Close(fd)
+		_ = store.Close()
+	})
+
+	return store, fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+}
+
+// testClient is a connection to the server under test.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// command encodes args as a RESP array.
+func command(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+func (c *testClient) send(s string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(s)); err != nil {
+		c.t.Fatalf("failed to send: %v", err)
+	}
+}
+
+// reply reads one reply line, or the header and the data of a bulk string.
+func (c *testClient) reply() string {
+	c.t.Helper()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("failed to read reply: %v", err)
+	}
+	if line[0] != '$' || line == "$-1\r\n" {
+		return line
+	}
+	var n int
+	if _, err := fmt.Sscanf(line, "$%d\r\n", &n); err != nil {
+		c.t.Fatalf("malformed bulk reply %q", line)
+	}
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		c.t.Fatalf("failed to read bulk reply: %v", err)
+	}
+	return line + string(data)
+}
+
+func (c *testClient) expect(want string) {
+	c.t.Helper()
+	if got := c.reply(); got != want {
+		c.t.Fatalf("got reply %q, want %q", got, want)
+	}
+}
+
+func TestGroupCommitAcrossClients(t *testing.T) {
+	const clients = 16
+	store, addr := startServer(t,
+		config.WithSyncMode(config.SyncEveryWrite),
+		config.WithGroupCommit(true),
+		config.WithGroupCommitWait(50*time.Millisecond),
+	)
+
+	conns := make([]*testClient, clients)
+	for i := range conns {
+		conns[i] = dial(t, addr)
+	}
+	for i, c := range conns {
+		c.send(command("SET", fmt.Sprintf("key%d", i), "value"))
+	}
+	for _, c := range conns {
+		c.expect("+OK\r\n")
+	}
+
+	if syncs := store.Syncs(); syncs == 0 || syncs >= clients {
+		t.Fatalf("got %d syncs for %d clients, want them shared", syncs, clients)
+	}
+}
+
+func TestDurableWriteDoesNotBlockLoop(t *testing.T) {
+	const wait = time.Second
+	_, addr := startServer(t,
+		config.WithSyncMode(config.SyncEveryWrite),
+		config.WithGroupCommit(true),
+		config.WithGroupCommitWait(wait),
+	)
+
+	writer, reader := dial(t, addr), dial(t, addr)
+	start := time.Now()
+	writer.send(command("SET", "key", "value") + command("GET", "key"))
+	// make sure the write is in before the read
+	time.Sleep(10 * time.Millisecond)
+	reader.send(command("PING"))
+	reader.expect("+PONG\r\n")
+	if elapsed := time.Since(start); elapsed >= wait/2 {
+		t.Fatalf("PING took %v while a write waited for its sync", elapsed)
+	}
+
+	// the replies of the writer are held back until the sync, in order
+	writer.expect("+OK\r\n")
+	writer.expect("$5\r\nvalue\r\n")
+	if elapsed := time.Since(start); elapsed < wait {
+		t.Fatalf("write acknowledged after %v, before its sync", elapsed)
+	}
+}
+
+func TestBackupInBackground(t *testing.T) {
+	root := t.TempDir()
+	_, addr := startServer(t, config.WithBackupDir(root))
+	c := dial(t, addr)
+
+	for i := 0; i < 100; i++ {
+		c.send(command("SET", fmt.Sprintf("key%d", i), strings.Repeat("v", 1024)))
+		c.expect("+OK\r\n")
+	}
+
+	c.send(command("BACKUP", "backup") + command("PING"))
+	c.expect("+Backup started\r\n")
+	c.expect("+PONG\r\n")
+
+	want := "$9\r\nok backup\r\n"
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.send(command("BACKUP", "STATUS"))
+		got := c.reply()
+		if got == want {
+			break
+		}
+		if !strings.Contains(got, "running") || time.Now().After(deadline) {
+			t.Fatalf("backup status: got %q, want %q", got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "backup", "MANIFEST")); err != nil {
+		t.Fatalf("backup has no manifest: %v", err)
+	}
+}
+
+func TestAcceptConnections(t *testing.T) {
+	_, addr := startServer(t)
+
+	conns := make([]*testClient, 10)
+	for i := range conns {
+		conns[i] = dial(t, addr)
+	}
+	for i, c := range conns {
+		c.send(command("SET", fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)))
+	}
+	for _, c := range conns {
+		c.expect("+OK\r\n")
+	}
+	// every client sees the writes of the others
+	for i, c := range conns {
+		j := (i + 1) % len(conns)
+		c.send(command("GET", fmt.Sprintf("key%d", j)))
+		c.expect(fmt.Sprintf("$%d\r\nvalue%d\r\n", len(fmt.Sprint("value", j)), j))
+	}
+}
+
+func TestPipelinedCommands(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	const n = 1000
+	var pipeline strings.Builder
+	for i := 0; i < n; i++ {
+		pipeline.WriteString(command("SET", "counter", fmt.Sprint(i)))
+		pipeline.WriteString(command("GET", "counter"))
+	}
+	c.send(pipeline.String())
+	for i := 0; i < n; i++ {
+		c.expect("+OK\r\n")
+		c.expect(fmt.Sprintf("$%d\r\n%d\r\n", len(fmt.Sprint(i)), i))
+	}
+
+	// commands split anywhere, even inside a length, are put back together
+	pipeline.Reset()
+	for i := 0; i < 3; i++ {
+		pipeline.WriteString(command("PING", fmt.Sprint("split", i)))
+	}
+	for _, b := range []byte(pipeline.String()) {
+		c.send(string(b))
+	}
+	for i := 0; i < 3; i++ {
+		c.expect(fmt.Sprintf("$6\r\nsplit%d\r\n", i))
+	}
+}
+
+func TestPartialWrites(t *testing.T) {
+	_, addr := startServer(t)
+	slow, other := dial(t, addr), dial(t, addr)
+
+	value := strings.Repeat("x", 256*1024)
+	slow.send(command("SET", "big", value))
+	slow.expect("+OK\r\n")
+
+	// far more replies than the socket buffers hold: the server has to stop
+	// on EAGAIN and finish once the client reads
+	const gets = 128
+	var pipeline strings.Builder
+	for i := 0; i < gets; i++ {
+		pipeline.WriteString(command("GET", "big"))
+	}
+	pipeline.WriteString(command("PING", "last"))
+	go func() {
+		_, _ = slow.conn.Write([]byte(pipeline.String()))
+	}()
+
+	// the stuck client does not hold up the others
+	time.Sleep(50 * time.Millisecond)
+	other.send(command("PING"))
+	other.expect("+PONG\r\n")
+
+	want := fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	for i := 0; i < gets; i++ {
+		if got := slow.reply(); got != want {
+			t.Fatalf("reply %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	slow.expect("$4\r\nlast\r\n")
+}
+
+func TestClientClosesMidRequest(t *testing.T) {
+	_, addr := startServer(t)
+
+	// a command cut short is dropped with its connection
+	c := dial(t, addr)
+	c.send("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nval")
+	c.conn.Close()
+
+	// replies to commands sent before the client shut its end down are
+	// still delivered
+	c = dial(t, addr)
+	c.send(command("SET", "key", "value") + command("GET", "key"))
+	if err := c.conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	c.expect("+OK\r\n")
+	c.expect("$5\r\nvalue\r\n")
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Fatalf("got %v after the last reply, want the connection closed", err)
+	}
+
+	c = dial(t, addr)
+	c.send(command("GET", "key"))
+	c.expect("$5\r\nvalue\r\n")
+}
+
+func TestIdleConnections(t *testing.T) {
+	_, addr := startServer(t)
+
+	const idle = 2000
+	conns := make([]net.Conn, idle)
+	for i := range conns {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	// the event loop is not held up by the idle connections
+	start := time.Now()
+	c := dial(t, addr)
+	c.send(command("PING"))
+	c.expect("+PONG\r\n")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("PING took %v with %d idle connections", elapsed, idle)
+	}
+
+	// and every one of them is still served
+	for i := 0; i < idle; i += idle / 10 {
+		ic := &testClient{t: t, conn: conns[i], r: bufio.NewReader(conns[i])}
+		ic.send(command("PING", "idle"))
+		ic.expect("$4\r\nidle\r\n")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ajaxchavan/bytecask/internal/core"
+)
+
+// serve is only implemented on top of epoll for now.
+func serve(ctx context.Context, serverFd int, store *core.Store) error {
+	return errors.New("the event loop is only supported on linux")
+}
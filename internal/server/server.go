@@ -2,9 +2,7 @@ package server
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"io"
 	"net"
 	"sync"
 	"syscall"
@@ -17,100 +15,46 @@ import (
 func RunServer(ctx context.Context, wg *sync.WaitGroup, store *core.Store) {
 	defer wg.Done()
 
+	serverSocket, err := listen(6969)
+	if err != nil {
+		store.Log.Fatal("failed to listen", zap.Error(err))
+	}
+	defer syscall.Close(serverSocket)
+
+	if err := serve(ctx, serverSocket, store); err != nil {
+		store.Log.Fatal("event loop failed", zap.Error(err))
+	}
+}
+
+// listen returns a nonblocking socket listening on port of the loopback
+// interface, zero picking a free port.
+func listen(port int) (int, error) {
 	serverSocket, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
 	if err != nil {
-		store.Log.Fatal("failed to create socket", zap.Error(err))
+		return -1, fmt.Errorf("failed to create socket: %w", err)
 	}
 
 	if err := syscall.SetNonblock(serverSocket, true); err != nil {
-		store.Log.Fatal("failed to set nonblocking socket")
+		syscall.Close(serverSocket)
+		return -1, fmt.Errorf("failed to set nonblocking socket: %w", err)
 	}
 
-	serverAddr := &syscall.SockaddrInet4{Port: 6969}
+	serverAddr := &syscall.SockaddrInet4{Port: port}
 	copy(serverAddr.Addr[:], net.ParseIP("127.0.0.1").To4())
 
 	if err := syscall.SetsockoptInt(serverSocket, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
-		store.Log.Fatal("failed to set SO_REUSEADDR:", zap.Error(err))
+		syscall.Close(serverSocket)
+		return -1, fmt.Errorf("failed to set SO_REUSEADDR: %w", err)
 	}
 
 	if err := syscall.Bind(serverSocket, serverAddr); err != nil {
-		store.Log.Fatal("failed to bind socket", zap.Error(err))
-	}
-
-	if err := syscall.Listen(serverSocket, 100); err != nil {
-		store.Log.Fatal("failed to connect server", zap.Error(err))
-	}
-
-	defer syscall.Close(serverSocket)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			fd, _, err := syscall.Accept(serverSocket)
-			if err != nil {
-				var errno syscall.Errno
-				if errors.As(err, &errno) && (errno == syscall.EAGAIN || errno == syscall.EWOULDBLOCK) {
-					continue
-				}
-				select {
-				case <-ctx.Done():
-					// Context canceled while waiting for Accept, exit the goroutine
-					return
-				default:
-					store.Log.Fatal("failed to accept connection", zap.Error(err))
-				}
-			}
-
-			// Make the accepted socket non-blocking
-			if err := syscall.SetNonblock(fd, true); err != nil {
-				store.Log.Fatal("failed to set socket to non-blocking", zap.Error(err))
-			}
-
-			go handleConnection(ctx, fd, store)
-		}
+		syscall.Close(serverSocket)
+		return -1, fmt.Errorf("failed to bind socket: %w", err)
 	}
 
-}
-
-func handleConnection(ctx context.Context, fd int, store *core.Store) {
-	defer syscall.Close(fd)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			client := core.NewClient(fd)
-			cmd, err := readCmd(client)
-			if err != nil {
-				_, _ = client.Write([]byte("invalid cmd\r\n"))
-				const msg = "failed to read cmd"
-				store.Log.Error(msg, zap.Error(err))
-				continue
-			}
-			if cmd == nil {
-				_, _ = client.Write([]byte("syntax error\r\n"))
-				continue
-			}
-
-			response(store, cmd, client)
-		}
+	if err := syscall.Listen(serverSocket, syscall.SOMAXCONN); err != nil {
+		syscall.Close(serverSocket)
+		return -1, fmt.Errorf("failed to listen on socket: %w", err)
 	}
-}
-
-func readCmd(c io.ReadWriter) (*core.Cmd, error) {
-	rp, err := core.NewParser(c)
-	if err != nil {
-		return nil, fmt.Errorf("unable to build parser %s", err)
-	}
-	p, err := rp.Decode()
-	if err != nil {
-		return nil, fmt.Errorf("unable to decode %s", err)
-	}
-
-	return core.NewCmd(p), nil
-}
-
-func response(store *core.Store, cmd *core.Cmd, client *core.Client) {
-	store.EvalAndResponse(cmd, client)
+	return serverSocket, nil
 }
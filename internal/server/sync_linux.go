@@ -0,0 +1,80 @@
+package server
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/ajaxchavan/bytecask/internal/core"
+)
+
+// syncResult is the outcome of the sync the replies of a connection were held
+// back for.
+type syncResult struct {
+	c   *connection
+	err error
+}
+
+// syncWaiter waits off the event loop for the syncs that held back replies
+// wait on, and hands the outcomes back to the loop. Connections waiting at
+// the same time share syncs through the store's group commit.
+type syncWaiter struct {
+	store *core.Store
+	// the read end of the pipe becomes readable once a sync is done
+	wake [2]int
+	wg   sync.WaitGroup
+
+	mu   sync.Mutex
+	done []syncResult
+}
+
+func newSyncWaiter(store *core.Store) (*syncWaiter, error) {
+	w := &syncWaiter{store: store}
+	if err := syscall.Pipe2(w.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// fd returns the descriptor the event loop polls for finished syncs.
+func (w *syncWaiter) fd() int {
+	return w.wake[0]
+}
+
+// wait waits for the first seq appends to be on disk and then hands c back
+// to the event loop.
+func (w *syncWaiter) wait(c *connection, seq uint64) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		err := w.store.WaitSynced(seq)
+		w.mu.Lock()
+		w.done = append(w.done, syncResult{c: c, err: err})
+		w.mu.Unlock()
+		// a full pipe wakes the loop up just as well
+		_, _ = syscall.Write(w.wake[1], []byte{0})
+	}()
+}
+
+// results returns the syncs done since the last call. The pipe is drained
+// first, a sync done meanwhile wakes the loop up again.
+func (w *syncWaiter) results() []syncResult {
+	var buf [64]byte
+	for {
+		if n, _ := syscall.Read(w.wake[0], buf[:]); n < len(buf) {
+			break
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	done := w.done
+	w.done = nil
+	return done
+}
+
+// Close waits for the syncs still being waited for and closes the pipe.
+func (w *syncWaiter) Close() error {
+	w.wg.Wait()
+	_ = syscall.Close(w.wake[1])
+	return syscall.Close(w.wake[0])
+}
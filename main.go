@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/ajaxchavan/bytecask/internal/config"
 	"github.com/ajaxchavan/bytecask/internal/core"
@@ -16,11 +17,52 @@ import (
 	"github.com/ajaxchavan/bytecask/internal/server"
 )
 
+// subcommands run in place of the server when named as the first argument.
+var subcommands = map[string]func(args []string) error{
+	"restore": runRestore,
+	"dump":    runDump,
+	"fsck":    runFsck,
+	"repair":  runRepair,
+	"stats":   runStats,
+	"upgrade": runUpgrade,
+}
+
 func main() {
-	hint := flag.Bool("hint", false, "specify to build key directory from scratch and not to use hint_file")
-	fsync := flag.Bool("fsync", false, "specify to fsync datafile after every write")
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	syncMode := flag.String("sync", "interval", "when writes are synced to disk: never, interval, always or bytes")
+	syncInterval := flag.Duration("sync-interval", time.Minute, "how often -sync interval syncs")
+	syncBytes := flag.Int64("sync-bytes", 1024*1024, "bytes -sync bytes lets through before it syncs")
+	fsync := flag.Bool("fsync", false, "same as -sync always")
+	mmapReads := flag.Bool("mmap-reads", false, "read sealed datafiles through memory mappings")
+	groupCommit := flag.Bool("group-commit", false, "with -sync always, let concurrent writes share one fdatasync")
+	groupCommitWait := flag.Duration("group-commit-wait", 0, "how long a group commit waits for more writes before it syncs")
+	groupCommitSize := flag.Int("group-commit-size", 0, "number of waiting writes that starts a group commit sync early, 0 for no limit")
+	maxDatafileSize := flag.Int64("max-datafile-size", 128*1024*1024, "size in bytes after which the active datafile is rotated")
+	mergeDeadRatio := flag.Float64("merge-dead-ratio", 0.5, "share of dead bytes from which a datafile is merged")
+	mergeMinDeadBytes := flag.Int64("merge-min-dead-bytes", 0, "dead bytes from which a datafile is merged whatever its ratio, 0 to disable")
+	compactKeyDir := flag.Bool("compact-keydir", false, "keep the key directory in pointer-free slabs, for stores with a great many keys")
+	keyDirShards := flag.Int("keydir-shards", 32, "number of shards the key directory is split into, each with its own lock")
+	backupDir := flag.String("backup-dir", "backups", "directory BACKUP writes checkpoints under")
 	flag.Parse()
 
+	mode, err := config.ParseSyncMode(*syncMode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *fsync {
+		mode = config.SyncEveryWrite
+	}
+
 	// Create a context that can be cancelled
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -38,9 +80,23 @@ func main() {
 
 	var wg sync.WaitGroup
 
-	cfg := config.NewConfig(config.WithFsync(*fsync))
-
-	store, err := core.New(*cfg, *logger, *hint)
+	cfg := config.NewConfig(
+		config.WithSyncMode(mode),
+		config.WithSyncInterval(*syncInterval),
+		config.WithSyncBytes(*syncBytes),
+		config.WithMmapReads(*mmapReads),
+		config.WithGroupCommit(*groupCommit),
+		config.WithGroupCommitWait(*groupCommitWait),
+		config.WithGroupCommitSize(*groupCommitSize),
+		config.WithMaxDatafileSize(*maxDatafileSize),
+		config.WithMergeDeadRatio(*mergeDeadRatio),
+		config.WithMergeMinDeadBytes(*mergeMinDeadBytes),
+		config.WithCompactKeyDir(*compactKeyDir),
+		config.WithKeyDirShards(*keyDirShards),
+		config.WithBackupDir(*backupDir),
+	)
+
+	store, err := core.New(*cfg, *logger)
 	if err != nil {
 		logger.Fatal("failed to create store object", zap.Error(err))
 	}
@@ -55,15 +111,16 @@ func main() {
 	go store.Compact(ctx, &wg)
 
 	wg.Add(1)
-	go store.UpdateActiveDatafile(ctx, &wg)
+	go store.ExpireKeys(ctx, &wg)
 
 	<-signals
 	logger.Info("shutting down....")
 
 	// tell goroutines to stop
 	cancel()
-	store.Shutdown()
 
-	// wait them all to reply back.
+	// wait them all to reply back before releasing the store, a merge in
+	// progress gives up as soon as it sees the cancellation.
 	wg.Wait()
+	store.Shutdown()
 }
@@ -0,0 +1,416 @@
+// Package bytecask embeds the bytecask storage engine in a Go program. It
+// gives direct access to the same datafiles the server uses, without going
+// through the network protocol.
+package bytecask
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ajaxchavan/bytecask/internal/config"
+	"github.com/ajaxchavan/bytecask/internal/core"
+	"github.com/ajaxchavan/bytecask/internal/log"
+)
+
+var (
+	// ErrNotFound is returned when a key does not exist.
+	ErrNotFound error = core.ErrKeyNotFound
+	// ErrCorrupt is returned when a stored record fails its checksum.
+	ErrCorrupt error = core.ErrCorruptRecord
+	// ErrLocked is returned by Open when another process has the directory
+	// open for writing.
+	ErrLocked error = core.ErrLocked
+	// ErrReadOnly is returned by writes to a DB opened with WithReadOnly.
+	ErrReadOnly error = core.ErrReadOnly
+	// ErrSnapshotReleased is returned by reads from a released snapshot.
+	ErrSnapshotReleased error = core.ErrSnapshotReleased
+	// ErrClosed is returned by every method once the DB is closed.
+	ErrClosed = errors.New("bytecask: database is closed")
+)
+
+// Option configures a DB opened with Open.
+type Option func(*config.Opts)
+
+// SyncMode is when writes are synced to disk. Sync syncs whatever the mode.
+type SyncMode = config.SyncMode
+
+const (
+	// SyncNever leaves writing back to the operating system.
+	SyncNever = config.SyncNever
+	// SyncEveryInterval syncs in the background, see WithSyncInterval. It is
+	// the default.
+	SyncEveryInterval = config.SyncEveryInterval
+	// SyncEveryWrite syncs every write before it returns.
+	SyncEveryWrite = config.SyncEveryWrite
+	// SyncEveryBytes syncs once the bytes set by WithSyncBytes were written.
+	SyncEveryBytes = config.SyncEveryBytes
+)
+
+// WithSyncMode sets when writes are synced to disk.
+func WithSyncMode(mode SyncMode) Option {
+	return Option(config.WithSyncMode(mode))
+}
+
+// WithFsync syncs the active datafile to disk after every write, it is
+// WithSyncMode(SyncEveryWrite).
+func WithFsync(fsync bool) Option {
+	return Option(config.WithFsync(fsync))
+}
+
+// WithSyncBytes sets how many bytes SyncEveryBytes writes between syncs.
+func WithSyncBytes(size int64) Option {
+	return Option(config.WithSyncBytes(size))
+}
+
+// WithMmapReads maps datafiles into memory once nothing is appended to them
+// anymore, so reads of them take no system call and View takes no copy.
+func WithMmapReads(mmap bool) Option {
+	return Option(config.WithMmapReads(mmap))
+}
+
+// WithGroupCommit lets writers from several goroutines share one sync with
+// SyncEveryWrite. A write returns once a sync that covers it is done.
+func WithGroupCommit(groupCommit bool) Option {
+	return Option(config.WithGroupCommit(groupCommit))
+}
+
+// WithGroupCommitWait sets how long a group commit waits for more writers
+// before it syncs. Longer waits trade latency for fewer syncs.
+func WithGroupCommitWait(wait time.Duration) Option {
+	return Option(config.WithGroupCommitWait(wait))
+}
+
+// WithGroupCommitSize sets the number of waiting writers that starts a group
+// commit sync before its wait is up. Zero means no limit.
+func WithGroupCommitSize(size int) Option {
+	return Option(config.WithGroupCommitSize(size))
+}
+
+// WithMaxDatafileSize sets the size in bytes after which writes move on to a
+// new datafile.
+func WithMaxDatafileSize(size int64) Option {
+	return Option(config.WithMaxDatafileSize(size))
+}
+
+// WithReadOnly opens the directory for reading only. A read-only DB does not
+// lock the directory and can be opened next to a writer.
+func WithReadOnly(readOnly bool) Option {
+	return Option(config.WithReadOnly(readOnly))
+}
+
+// WithSyncInterval sets how often SyncEveryInterval syncs the active datafile
+// to disk in the background.
+func WithSyncInterval(interval time.Duration) Option {
+	return Option(config.WithSyncInterval(interval))
+}
+
+// WithMergeInterval sets how often datafiles are compacted in the background.
+func WithMergeInterval(interval time.Duration) Option {
+	return Option(config.WithMergeInterval(interval))
+}
+
+// WithMergeDeadRatio sets the share of dead bytes, between 0 and 1, from which
+// a datafile is rewritten by compaction.
+func WithMergeDeadRatio(ratio float64) Option {
+	return Option(config.WithMergeDeadRatio(ratio))
+}
+
+// WithMergeMinDeadBytes sets the number of dead bytes from which a datafile is
+// rewritten by compaction whatever its ratio. Zero turns the check off.
+func WithMergeMinDeadBytes(size int64) Option {
+	return Option(config.WithMergeMinDeadBytes(size))
+}
+
+// WithCompactKeyDir keeps the in-memory index of keys in large pointer-free
+// slabs. It takes about half the memory per key and next to no garbage
+// collection work, lookups are somewhat slower.
+func WithCompactKeyDir(compact bool) Option {
+	return Option(config.WithCompactKeyDir(compact))
+}
+
+// WithKeyDirShards sets the number of shards the in-memory index of keys is
+// split into. Reads never wait on each other, and only wait on writes to keys
+// of the same shard.
+func WithKeyDirShards(shards int) Option {
+	return Option(config.WithKeyDirShards(shards))
+}
+
+// DB is a bytecask database opened in process. It is safe for concurrent use.
+type DB struct {
+	store  *core.Store
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Open opens the database in dir, creating the directory if it does not
+// exist. Background syncing and compaction run until the DB is closed.
+func Open(dir string, opts ...Option) (*DB, error) {
+	fns := []config.OptFunc{config.WithDirectoryPath(""), config.WithDirectory(dir)}
+	for _, opt := range opts {
+		fns = append(fns, config.OptFunc(opt))
+	}
+
+	store, err := core.New(*config.NewConfig(fns...), log.Log{Logger: zap.NewNop()})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	db := &DB{
+		store:  store,
+		cancel: cancel,
+	}
+
+	db.wg.Add(3)
+	go store.AsyncFlush(ctx, &db.wg)
+	go store.Compact(ctx, &db.wg)
+	go store.ExpireKeys(ctx, &db.wg)
+
+	return db, nil
+}
+
+// Get returns the value stored for key, or ErrNotFound.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	return db.store.Get(string(key))
+}
+
+// View calls fn with the value stored for key, or returns ErrNotFound. With
+// WithMmapReads the value is not copied out of the datafile, so fn must
+// neither change it nor keep it after it returns. The error fn returns is
+// returned by View.
+func (db *DB) View(key []byte, fn func(value []byte) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	return db.store.View(string(key), fn)
+}
+
+// Has reports whether key exists. It does not read the value.
+func (db *DB) Has(key []byte) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return false, ErrClosed
+	}
+
+	return db.store.Has(string(key)), nil
+}
+
+// Put stores value for key, replacing any previous value.
+func (db *DB) Put(key, value []byte) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	return db.store.Put(string(key), value)
+}
+
+// Delete removes key. Deleting a key that does not exist is not an error.
+func (db *DB) Delete(key []byte) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	_, err := db.store.Delete(string(key))
+	return err
+}
+
+// Iterator walks a range of keys in order along with their values. Writes
+// made while iterating are seen if they land after the current key.
+type Iterator struct {
+	db  *DB
+	it  *core.Iterator
+	err error
+}
+
+// Iterator returns an iterator over the keys from start on and before end. A
+// nil end leaves the range unbounded.
+func (db *DB) Iterator(start, end []byte) *Iterator {
+	return &Iterator{db: db, it: db.store.Iterator(string(start), string(end))}
+}
+
+// Prefix returns an iterator over the keys starting with prefix.
+func (db *DB) Prefix(prefix []byte) *Iterator {
+	return &Iterator{db: db, it: db.store.Prefix(string(prefix))}
+}
+
+// Next moves to the next key and reports whether there is one.
+func (it *Iterator) Next() bool {
+	it.db.mu.RLock()
+	defer it.db.mu.RUnlock()
+	if it.db.closed {
+		it.err = ErrClosed
+		return false
+	}
+
+	return it.it.Next()
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() []byte {
+	return []byte(it.it.Key())
+}
+
+// Value returns the value of the current key.
+func (it *Iterator) Value() []byte {
+	return it.it.Value()
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.it.Err()
+}
+
+// Snapshot is a read-only view of the database as it was when it was taken.
+// Writes made afterwards are not seen. Compaction keeps the datafiles a
+// snapshot reads from until it is released.
+type Snapshot struct {
+	db   *DB
+	snap *core.Snapshot
+}
+
+// Snapshot takes a snapshot of the database. It must be released once done
+// with.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	return &Snapshot{db: db, snap: db.store.Snapshot()}, nil
+}
+
+// Get returns the value key had when the snapshot was taken, or ErrNotFound.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	if s.db.closed {
+		return nil, ErrClosed
+	}
+
+	return s.snap.Get(string(key))
+}
+
+// Has reports whether key existed when the snapshot was taken.
+func (s *Snapshot) Has(key []byte) bool {
+	return s.snap.Has(string(key))
+}
+
+// Iterator returns an iterator over the keys of the snapshot from start on
+// and before end. A nil end leaves the range unbounded.
+func (s *Snapshot) Iterator(start, end []byte) *Iterator {
+	return &Iterator{db: s.db, it: s.snap.Iterator(string(start), string(end))}
+}
+
+// Prefix returns an iterator over the keys of the snapshot starting with
+// prefix.
+func (s *Snapshot) Prefix(prefix []byte) *Iterator {
+	return &Iterator{db: s.db, it: s.snap.Prefix(string(prefix))}
+}
+
+// Release releases the snapshot. Reads from it fail afterwards.
+func (s *Snapshot) Release() {
+	s.snap.Release()
+}
+
+// Batch collects writes that Write applies atomically. The zero value is an
+// empty batch ready to use.
+type Batch struct {
+	batch core.WriteBatch
+}
+
+// Put adds a write of value for key to the batch.
+func (b *Batch) Put(key, value []byte) {
+	b.batch.Put(string(key), value)
+}
+
+// Delete adds a deletion of key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.batch.Delete(string(key))
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return b.batch.Len()
+}
+
+// Reset empties the batch so it can be reused.
+func (b *Batch) Reset() {
+	b.batch.Reset()
+}
+
+// Write applies the writes of b in order. After a crash either all of them
+// are found or none.
+func (db *DB) Write(b *Batch) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	return db.store.Write(&b.batch)
+}
+
+// Sync returns once every write made so far is on disk. Concurrent calls
+// share a sync.
+func (db *DB) Sync() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	return db.store.Sync()
+}
+
+// Checkpoint writes a consistent copy of the database into dir, which must be
+// empty or not exist, while reads and writes go on. Datafiles are hard linked
+// when dir is on the same file system.
+func (db *DB) Checkpoint(dir string) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	return db.store.Checkpoint(dir)
+}
+
+// Close stops the background work, flushes the active datafile and releases
+// the directory. Closing a closed DB returns ErrClosed.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.closed = true
+
+	db.cancel()
+	db.wg.Wait()
+	return db.store.Close()
+}
@@ -0,0 +1,180 @@
+package bytecask_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ajaxchavan/bytecask/pkg/bytecask"
+)
+
+func TestOpen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+
+	db, err := bytecask.Open(dir, bytecask.WithMaxDatafileSize(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%d", i)), []byte{byte(i), 0, '\r', '\n'}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete([]byte("key3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("missing")); err != nil {
+		t.Fatalf("deleting a missing key: %v", err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bytecask.Open(dir); !errors.Is(err, bytecask.ErrLocked) {
+		t.Fatalf("second open: got %v, want ErrLocked", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get([]byte("key1")); !errors.Is(err, bytecask.ErrClosed) {
+		t.Fatalf("get after close: got %v, want ErrClosed", err)
+	}
+
+	db, err = bytecask.Open(dir, bytecask.WithMmapReads(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		value, err := db.Get(key)
+		if i == 3 {
+			if !errors.Is(err, bytecask.ErrNotFound) {
+				t.Fatalf("get %s: got %v, want ErrNotFound", key, err)
+			}
+			if ok, err := db.Has(key); ok || err != nil {
+				t.Fatalf("has %s: got %v, %v", key, ok, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("get %s: %v", key, err)
+		}
+		if want := []byte{byte(i), 0, '\r', '\n'}; !bytes.Equal(value, want) {
+			t.Fatalf("get %s: got %q, want %q", key, value, want)
+		}
+		if ok, err := db.Has(key); !ok || err != nil {
+			t.Fatalf("has %s: got %v, %v", key, ok, err)
+		}
+		err = db.View(key, func(value []byte) error {
+			if want := []byte{byte(i), 0, '\r', '\n'}; !bytes.Equal(value, want) {
+				return fmt.Errorf("got %q, want %q", value, want)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("view %s: %v", key, err)
+		}
+	}
+	if err := db.View([]byte("key3"), func([]byte) error { return nil }); !errors.Is(err, bytecask.ErrNotFound) {
+		t.Fatalf("view key3: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := bytecask.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := bytecask.Open(dir, bytecask.WithReadOnly(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if value, err := ro.Get([]byte("k")); err != nil || string(value) != "v" {
+		t.Fatalf("get: got %q, %v", value, err)
+	}
+	if err := ro.Put([]byte("k"), []byte("w")); !errors.Is(err, bytecask.ErrReadOnly) {
+		t.Fatalf("put: got %v, want ErrReadOnly", err)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	db, err := bytecask.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"user:3", "order:1", "user:1", "user:2", "users", "order:2"} {
+		if err := db.Put([]byte(key), []byte("v-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete([]byte("user:2")); err != nil {
+		t.Fatal(err)
+	}
+
+	collect := func(it *bytecask.Iterator) []string {
+		t.Helper()
+		var keys []string
+		for it.Next() {
+			if want := "v-" + string(it.Key()); string(it.Value()) != want {
+				t.Fatalf("value of %s: got %q, want %q", it.Key(), it.Value(), want)
+			}
+			keys = append(keys, string(it.Key()))
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	if got := fmt.Sprint(collect(db.Prefix([]byte("user:")))); got != "[user:1 user:3]" {
+		t.Fatalf("prefix user: got %s", got)
+	}
+	if got := fmt.Sprint(collect(db.Iterator([]byte("order:2"), []byte("user:3")))); got != "[order:2 user:1]" {
+		t.Fatalf("range: got %s", got)
+	}
+	if got := fmt.Sprint(collect(db.Iterator(nil, nil))); got != "[order:1 order:2 user:1 user:3 users]" {
+		t.Fatalf("everything: got %s", got)
+	}
+}
+
+func Example() {
+	dir, err := os.MkdirTemp("", "bytecask")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := bytecask.Open(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("hello"), []byte("world")); err != nil {
+		panic(err)
+	}
+	value, err := db.Get([]byte("hello"))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(value))
+	// Output: world
+}
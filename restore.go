@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ajaxchavan/bytecask/internal/core"
+)
+
+// runRestore puts a checkpoint written by BACKUP in place as the data
+// directory, after checking it against its manifest.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("dir", ".data", "data directory to restore into, it must not hold any datafiles")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: bytecask restore [-dir path] <checkpoint>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := core.Restore(fs.Arg(0), *dir); err != nil {
+		if errors.Is(err, core.ErrCorruptCheckpoint) {
+			return fmt.Errorf("refusing to restore: %w", err)
+		}
+		return err
+	}
+	fmt.Printf("restored %s into %s\n", fs.Arg(0), *dir)
+	return nil
+}
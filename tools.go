@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ajaxchavan/bytecask/internal/core"
+)
+
+// toolFlags parses the flags shared by the offline tools, which work on a data
+// directory no server has open, and returns the data directory.
+func toolFlags(fs *flag.FlagSet, args []string) string {
+	dir := fs.String("dir", ".data", "data directory to work on")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: bytecask %s [flags]\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return *dir
+}
+
+// runDump prints every record of the datafiles as a line of JSON.
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	values := fs.Bool("values", false, "include values, base64 encoded")
+	dir := toolFlags(fs, args)
+
+	w := bufio.NewWriter(os.Stdout)
+	if err := core.Dump(dir, w, *values); err != nil {
+		w.Flush()
+		return err
+	}
+	return w.Flush()
+}
+
+// runFsck checks the checksums of the records and the hint files, it fails
+// when it finds a problem.
+func runFsck(args []string) error {
+	dir := toolFlags(flag.NewFlagSet("fsck", flag.ExitOnError), args)
+
+	problems, err := core.Fsck(dir, os.Stdout)
+	if err != nil {
+		return err
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problems found, see bytecask repair", problems)
+	}
+	return nil
+}
+
+// runRepair truncates torn tails and rebuilds the hint files.
+func runRepair(args []string) error {
+	dir := toolFlags(flag.NewFlagSet("repair", flag.ExitOnError), args)
+	return core.Repair(dir, os.Stdout)
+}
+
+// runStats prints the live and dead bytes of every datafile.
+func runStats(args []string) error {
+	dir := toolFlags(flag.NewFlagSet("stats", flag.ExitOnError), args)
+	return core.Stats(dir, os.Stdout)
+}
+
+// runUpgrade rewrites the datafiles written before the format was versioned.
+func runUpgrade(args []string) error {
+	dir := toolFlags(flag.NewFlagSet("upgrade", flag.ExitOnError), args)
+	return core.Upgrade(dir, os.Stdout)
+}